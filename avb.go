@@ -0,0 +1,97 @@
+package magiskboot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"os"
+)
+
+const AVB_DESCRIPTOR_TAG_HASH = 2
+
+type AvbDescriptor struct {
+	Tag               uint64
+	NumBytesFollowing uint64
+}
+
+type AvbHashDescriptor struct {
+	Parent           AvbDescriptor
+	ImageSize        uint64
+	HashAlgorithm    [32]uint8
+	PartitionNameLen uint32
+	SaltLen          uint32
+	DigestLen        uint32
+	Flags            uint32
+	Reserved         [60]uint8
+}
+
+// Update image_size and digest of every hash descriptor in the vbmeta image
+func updateAvbHashDescriptor(meta []byte, image []byte) error {
+	var vbmeta AvbVBMetaImageHeader
+	if len(meta) < binary.Size(vbmeta) {
+		return truncated("%d bytes is less than vbmeta header", len(meta))
+	}
+	if !bytes.HasPrefix(meta, []byte(AVB_MAGIC)) {
+		return badMagic("invalid vbmeta magic")
+	}
+	binary.Read(bytes.NewReader(meta), binary.BigEndian, &vbmeta)
+	aux := uint64(binary.Size(vbmeta)) + vbmeta.AuthenticationDataBlockSize
+	if aux > uint64(len(meta)) || vbmeta.DescriptorsOffset > uint64(len(meta))-aux {
+		return truncated("vbmeta descriptors offset %d", vbmeta.DescriptorsOffset)
+	}
+	descs := meta[aux+vbmeta.DescriptorsOffset:]
+	descs = descs[:min(uint64(len(descs)), vbmeta.DescriptorsSize)]
+
+	desc_sz := uint64(binary.Size(AvbDescriptor{}))
+	hash_sz := uint64(binary.Size(AvbHashDescriptor{}))
+	for off := uint64(0); off+desc_sz <= uint64(len(descs)); {
+		var desc AvbDescriptor
+		binary.Read(bytes.NewReader(descs[off:]), binary.BigEndian, &desc)
+		if desc.NumBytesFollowing > uint64(len(descs))-off-desc_sz {
+			return truncated("vbmeta descriptor at %d", off)
+		}
+		buf := descs[off : off+desc_sz+desc.NumBytesFollowing]
+		off += uint64(len(buf))
+
+		if desc.Tag != AVB_DESCRIPTOR_TAG_HASH || uint64(len(buf)) < hash_sz {
+			continue
+		}
+		var d AvbHashDescriptor
+		binary.Read(bytes.NewReader(buf), binary.BigEndian, &d)
+		data := buf[hash_sz:]
+		if uint64(d.PartitionNameLen)+uint64(d.SaltLen)+uint64(d.DigestLen) > uint64(len(data)) {
+			return truncated("vbmeta hash descriptor at %d", off-uint64(len(buf)))
+		}
+		salt := data[d.PartitionNameLen : d.PartitionNameLen+d.SaltLen]
+		digest := data[d.PartitionNameLen+d.SaltLen : d.PartitionNameLen+d.SaltLen+d.DigestLen]
+
+		var h hash.Hash
+		switch alg := cstr(d.HashAlgorithm[:]); alg {
+		case "sha256":
+			h = sha256.New()
+		case "sha512":
+			h = sha512.New()
+		default:
+			return unsupported("hash algorithm %s", alg)
+		}
+		h.Write(salt)
+		h.Write(image)
+		sum := h.Sum(nil)
+		if len(sum) != len(digest) {
+			return unsupported("%d bytes digest of %s", len(digest), cstr(d.HashAlgorithm[:]))
+		}
+		copy(digest, sum)
+
+		d.ImageSize = uint64(len(image))
+		w := new(bytes.Buffer)
+		binary.Write(w, binary.BigEndian, &d)
+		copy(buf, w.Bytes())
+
+		fmt.Fprintf(os.Stderr, "%-*s [%s] size=[%d] digest=[%x]\n",
+			PADDING, "AVB_HASH", cstr(data[:d.PartitionNameLen]), d.ImageSize, digest)
+	}
+	return nil
+}
@@ -2,13 +2,17 @@ package magiskboot
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
-	"unsafe"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 
 	"github.com/edsrzf/mmap-go"
 )
@@ -20,6 +24,8 @@ type MtkHdr struct {
 	Padding [472]byte
 }
 
+const MTK_HDR_SZ = 512
+
 type DhtbHdr struct {
 	Magic    [8]byte
 	Checksum [40]uint8
@@ -27,6 +33,8 @@ type DhtbHdr struct {
 	Padding  [460]byte
 }
 
+const DHTB_HDR_SZ = 512
+
 //go:packed
 type BlobHdr struct {
 	SecureMagic [20]byte
@@ -44,6 +52,17 @@ type BlobHdr struct {
 	Version     uint32
 }
 
+// Partition entry following the tegra blob header
+type BlobPart struct {
+	Name    [4]byte
+	Offset  uint32
+	Size    uint32
+	Version uint32
+}
+
+// Offsets in tegra blob are relative to the end of the secure header
+const BLOB_SECURE_HDR_SZ = 28
+
 //go:packed
 type ZimageHdr struct {
 	Code   [9]uint32
@@ -278,426 +297,764 @@ type VendorRamdiskTableEntryV4 struct {
 
 // Define dyn_img_hdr api
 type DynImgHdrInterface interface {
+	// Parse the raw header, data must be large enough for the header version
+	Init(data []byte) error
+
 	IsVendor() bool
+	HdrSize() uint64
+	HdrSpace() uint64
+	RawHdr() ([]byte, error)
+
+	// Fields that do not exist in the header version read as 0,
+	// and writes to them are ignored
+	KernelSize() uint32
+	SetKernelSize(uint32)
+	RamdiskSize() uint32
+	SetRamdiskSize(uint32)
+	SecondSize() uint32
+	SetSecondSize(uint32)
+	ExtraSize() uint32
+	SetExtraSize(uint32)
 	PageSize() uint32
+	SetPageSize(uint32)
 	HeaderVersion() uint32
+	SetHeaderVersion(uint32)
+	OsVersion() uint32
+	SetOsVersion(uint32)
+	RecoveryDtboSize() uint32
+	SetRecoveryDtboSize(uint32)
+	RecoveryDtboOffset() uint64
+	SetRecoveryDtboOffset(uint64)
+	HeaderSize() uint32
+	SetHeaderSize(uint32)
+	DtbSize() uint32
+	SetDtbSize(uint32)
 	SignatureSize() uint32
+	SetSignatureSize(uint32)
 	VendorRamdiskTableSize() uint32
+	SetVendorRamdiskTableSize(uint32)
 	VendorRamdiskTableEntryNum() uint32
+	SetVendorRamdiskTableEntryNum(uint32)
 	VendorRamdiskTableEntrySize() uint32
-
-	HdrSize() uint64
-	HdrSpace() uint64
-	RawHdr() mmap.MMap
+	SetVendorRamdiskTableEntrySize(uint32)
+	BootconfigSize() uint32
+	SetBootconfigSize(uint32)
+
+	// Load addresses, v3/v4 boot headers have none
+	KernelAddr() uint32
+	SetKernelAddr(uint32)
+	RamdiskAddr() uint32
+	SetRamdiskAddr(uint32)
+	SecondAddr() uint32
+	SetSecondAddr(uint32)
+	TagsAddr() uint32
+	SetTagsAddr(uint32)
+	DtbAddr() uint64
+	SetDtbAddr(uint64)
+
+	// Byte arrays alias the header, nil if not exist
+	Name() []byte
+	SetName(string)
+	Cmdline() []byte
+	ExtraCmdline() []byte
+	// Overflow of cmdline goes to extra cmdline
+	SetCmdline(string)
+	Id() []byte
+	SetId([]byte)
 
 	Print()
-	DumpHdrFile()
-	LoadHdrFile()
+	DumpHdrFile() error
+	LoadHdrFile() error
 }
 
 type DynImgHdr struct {
-	KernelSize   uint32
-	RamdiskSize  uint32
-	SecondSize   uint32
-	ExtraSize    uint32
-	OsVersion    uint32
-	Name         string
-	Cmdline      string
-	Id           string
-	ExtraCmdline string
+	// Point to fields of the header below, nil if not exist
+	kernel_size    *uint32
+	ramdisk_size   *uint32
+	second_size    *uint32
+	extra_size     *uint32
+	page_size      *uint32
+	header_version *uint32
+	os_version     *uint32
+	name           []byte
+	cmdline        []byte
+	id             []byte
+	extra_cmdline  []byte
 
 	// v1/v2 specific
-	RecoveryDtboSize   uint32
-	RecoveryDtboOffset uint64
-	HeaderSize         uint32
-	DtbSize            uint32
+	recovery_dtbo_size   *uint32
+	recovery_dtbo_offset *uint64
+	header_size          *uint32
+	dtb_size             *uint32
+
+	// v4 specific
+	signature_size *uint32
 
 	// v4 vendor specific
-	VendorRamdiskTableSize      uint32
-	VendorRamdiskTableEntryNum  uint32
-	VendorRamdiskTableEntrySize uint32
-	BootconfigSize              uint32
+	vendor_ramdisk_table_size       *uint32
+	vendor_ramdisk_table_entry_num  *uint32
+	vendor_ramdisk_table_entry_size *uint32
+	bootconfig_size                 *uint32
+
+	// Load addresses
+	kernel_addr  *uint32
+	ramdisk_addr *uint32
+	second_addr  *uint32
+	tags_addr    *uint32
+	dtb_addr     *uint64
+
+	hdr_size  uint64
+	is_vendor bool
+	// The header below used by current version
+	raw any
 
 	// headers
-	V2Hdr  BootImgHdrV2
-	V4Hdr  BootImgHdrV4
-	V4Vnd  BootImgHdrVndV4
-	HdrPxa BootImgHdrPxa
-	// No raw pointer need to be defined...
+	v2_hdr  BootImgHdrV2
+	v4_hdr  BootImgHdrV4
+	v4_vnd  BootImgHdrVndV4
+	hdr_pxa BootImgHdrPxa
 }
 
-// Abstract
-func (d *DynImgHdr) IsVendor() bool {
-	return false
+func get32(p *uint32) uint32 {
+	if p == nil {
+		return 0
+	}
+	return *p
 }
 
-// Abstract
-func (d *DynImgHdr) HdrSize() uint64 {
-	return 0
+func set32(p *uint32, v uint32) {
+	if p != nil {
+		*p = v
+	}
 }
 
-func (d *DynImgHdr) HeaderVersion() uint32 {
-	return 0
+func get64(p *uint64) uint64 {
+	if p == nil {
+		return 0
+	}
+	return *p
 }
 
-func (d *DynImgHdr) PageSize() uint32 {
-	return 0
+func set64(p *uint64, v uint64) {
+	if p != nil {
+		*p = v
+	}
 }
 
-// v4 specific
-func (d *DynImgHdr) SignatureSize() uint32 {
-	return 0
+func (d *DynImgHdr) IsVendor() bool {
+	return d.is_vendor
+}
+
+func (d *DynImgHdr) HdrSize() uint64 {
+	return d.hdr_size
 }
 
 func (d *DynImgHdr) HdrSpace() uint64 {
+	if d.is_vendor {
+		return align_to(d.hdr_size, uint64(d.PageSize()))
+	}
 	return uint64(d.PageSize())
 }
 
-func (d *DynImgHdr) RawHdr() error {
-	return errors.New("not impl yet")
+// Serialize the header and cut it to the real size of current header version
+func (d *DynImgHdr) RawHdr() ([]byte, error) {
+	if d.raw == nil {
+		return nil, nil
+	}
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, d.raw); err != nil {
+		return nil, err
+	}
+	return buf.Bytes()[:d.hdr_size], nil
 }
 
-func (d *DynImgHdr) Print() {
-
+func (d *DynImgHdr) KernelSize() uint32 {
+	return get32(d.kernel_size)
 }
 
-func (d *DynImgHdr) DumpHdrFile() {
-
+func (d *DynImgHdr) SetKernelSize(v uint32) {
+	set32(d.kernel_size, v)
 }
 
-func (d *DynImgHdr) LoadHdrFile() {
+func (d *DynImgHdr) RamdiskSize() uint32 {
+	return get32(d.ramdisk_size)
+}
 
+func (d *DynImgHdr) SetRamdiskSize(v uint32) {
+	set32(d.ramdisk_size, v)
 }
 
-type DynImgHdrBoot struct {
-	DynImgHdr
+func (d *DynImgHdr) SecondSize() uint32 {
+	return get32(d.second_size)
 }
 
-func (d *DynImgHdrBoot) IsVendor() bool {
-	return false
+func (d *DynImgHdr) SetSecondSize(v uint32) {
+	set32(d.second_size, v)
 }
 
-type DynImgCommon struct {
-	DynImgHdrBoot
+func (d *DynImgHdr) ExtraSize() uint32 {
+	return get32(d.extra_size)
+}
 
-	KernelSize  *uint32
-	RamdiskSize *uint32
-	SecondSize  *uint32
+func (d *DynImgHdr) SetExtraSize(v uint32) {
+	set32(d.extra_size, v)
 }
 
-func (d *DynImgCommon) Init() {
-	d.KernelSize = &d.V2Hdr.KernelSize
-	d.RamdiskSize = &d.V2Hdr.RamdiskSize
-	d.SecondSize = &d.V2Hdr.SecondSize
+func (d *DynImgHdr) PageSize() uint32 {
+	return get32(d.page_size)
 }
 
-type DynImgV0 struct {
-	DynImgCommon
+func (d *DynImgHdr) SetPageSize(v uint32) {
+	if !d.fixedPageSize() {
+		set32(d.page_size, v)
+	}
+}
 
-	Raw BootImgHdrV0
+func (d *DynImgHdr) HeaderVersion() uint32 {
+	return get32(d.header_version)
+}
 
-	ExtraSize    *uint32
-	OsVersion    *uint32
-	Name         *[16]byte
-	Cmdline      *[512]byte
-	Id           *[32]byte
-	ExtraCmdline *[1024]byte
+func (d *DynImgHdr) SetHeaderVersion(v uint32) {
+	set32(d.header_version, v)
 }
 
-func (d *DynImgV0) HdrSize() int {
-	return binary.Size(BootImgHdrV0{})
+func (d *DynImgHdr) OsVersion() uint32 {
+	return get32(d.os_version)
 }
 
-func (d *DynImgV0) Init(data []byte) {
-	if len(data) < binary.Size(d.Raw) {
-		log.Fatalln("Error: Could not parse data size less than struct")
-	}
+func (d *DynImgHdr) SetOsVersion(v uint32) {
+	set32(d.os_version, v)
+}
 
-	buf := bytes.NewReader(data)
-	err := binary.Read(buf, binary.LittleEndian, &d.Raw)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	// copy data
-	d.V2Hdr.BootImgHdrV0 = d.Raw
+func (d *DynImgHdr) RecoveryDtboSize() uint32 {
+	return get32(d.recovery_dtbo_size)
+}
 
-	d.DynImgCommon.Init()
-	d.ExtraSize = &d.V2Hdr.HeaderVersion
-	d.OsVersion = &d.V2Hdr.OsVersion
-	d.Name = &d.V2Hdr.Name
-	d.Cmdline = &d.V2Hdr.Cmdline
-	d.Id = &d.V2Hdr.Id
-	d.ExtraCmdline = &d.V2Hdr.ExtraCmdline
+func (d *DynImgHdr) SetRecoveryDtboSize(v uint32) {
+	set32(d.recovery_dtbo_size, v)
 }
 
-func (d *DynImgV0) PageSize() uint32 {
-	return d.V2Hdr.PageSize
+func (d *DynImgHdr) RecoveryDtboOffset() uint64 {
+	return get64(d.recovery_dtbo_offset)
 }
 
-type DynImgV1 struct {
-	DynImgV0
+func (d *DynImgHdr) SetRecoveryDtboOffset(v uint64) {
+	set64(d.recovery_dtbo_offset, v)
+}
 
-	Raw BootImgHdrV1
+func (d *DynImgHdr) HeaderSize() uint32 {
+	return get32(d.header_size)
+}
 
-	RecoveryDtboSize   *uint32
-	RecoveryDtboOffset *uint64
-	HeaderSize         *uint32
+func (d *DynImgHdr) SetHeaderSize(v uint32) {
+	set32(d.header_size, v)
 }
 
-func (d *DynImgV1) HeaderVersion() uint32 {
-	return d.V2Hdr.HeaderVersion
+func (d *DynImgHdr) DtbSize() uint32 {
+	return get32(d.dtb_size)
 }
 
-func (d *DynImgV1) ExtraSize() uint32 {
-	return 0
+func (d *DynImgHdr) SetDtbSize(v uint32) {
+	set32(d.dtb_size, v)
 }
 
-func (d *DynImgV1) Init(data []byte) {
-	if len(data) < binary.Size(d.Raw) {
-		log.Fatalln("Error: Could not parse data size less than struct")
-	}
+func (d *DynImgHdr) SignatureSize() uint32 {
+	return get32(d.signature_size)
+}
 
-	buf := bytes.NewReader(data)
-	err := binary.Read(buf, binary.LittleEndian, &d.Raw)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	// init before
-	d.DynImgV0.Init(data)
+func (d *DynImgHdr) SetSignatureSize(v uint32) {
+	set32(d.signature_size, v)
+}
 
-	// copy data
-	d.V2Hdr.BootImgHdrV1 = d.Raw
+func (d *DynImgHdr) VendorRamdiskTableSize() uint32 {
+	return get32(d.vendor_ramdisk_table_size)
+}
 
-	d.RecoveryDtboSize = &d.V2Hdr.RecoveryDtboSize
-	d.RecoveryDtboOffset = &d.V2Hdr.RecoveryDtboOffset
-	d.HeaderSize = &d.V2Hdr.HeaderSize
+func (d *DynImgHdr) SetVendorRamdiskTableSize(v uint32) {
+	set32(d.vendor_ramdisk_table_size, v)
 }
 
-type DynImgV2 struct {
-	DynImgV1
+func (d *DynImgHdr) VendorRamdiskTableEntryNum() uint32 {
+	return get32(d.vendor_ramdisk_table_entry_num)
+}
 
-	Raw BootImgHdrV2
+func (d *DynImgHdr) SetVendorRamdiskTableEntryNum(v uint32) {
+	set32(d.vendor_ramdisk_table_entry_num, v)
+}
 
-	DtbSize *uint32
+func (d *DynImgHdr) VendorRamdiskTableEntrySize() uint32 {
+	return get32(d.vendor_ramdisk_table_entry_size)
 }
 
-func (d *DynImgV2) Init(data []byte) {
-	if len(data) < binary.Size(d.Raw) {
-		log.Fatalln("Error: Could not parse data size less than struct")
-	}
+func (d *DynImgHdr) SetVendorRamdiskTableEntrySize(v uint32) {
+	set32(d.vendor_ramdisk_table_entry_size, v)
+}
 
-	buf := bytes.NewReader(data)
-	err := binary.Read(buf, binary.LittleEndian, &d.Raw)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	// init before
-	d.DynImgV1.Init(data)
+func (d *DynImgHdr) BootconfigSize() uint32 {
+	return get32(d.bootconfig_size)
+}
 
-	// copy data
-	d.V2Hdr = d.Raw
+func (d *DynImgHdr) SetBootconfigSize(v uint32) {
+	set32(d.bootconfig_size, v)
+}
 
-	d.DtbSize = &d.V2Hdr.DtbSize
+func (d *DynImgHdr) KernelAddr() uint32 {
+	return get32(d.kernel_addr)
 }
 
-type DynImgPxa struct {
-	DynImgCommon
+func (d *DynImgHdr) SetKernelAddr(v uint32) {
+	set32(d.kernel_addr, v)
+}
 
-	Raw BootImgHdrPxa
+func (d *DynImgHdr) RamdiskAddr() uint32 {
+	return get32(d.ramdisk_addr)
+}
 
-	ExtraSize    *uint32
-	Name         *[24]byte
-	Cmdline      *[512]byte
-	Id           *[32]byte
-	ExtraCmdline *[1024]byte
+func (d *DynImgHdr) SetRamdiskAddr(v uint32) {
+	set32(d.ramdisk_addr, v)
 }
 
-func (d *DynImgPxa) PageSize() uint32 {
-	return d.HdrPxa.PageSize
+func (d *DynImgHdr) SecondAddr() uint32 {
+	return get32(d.second_addr)
 }
 
-func (d *DynImgPxa) Init(data []byte) {
-	if len(data) < binary.Size(d.Raw) {
-		log.Fatalln("Error: Could not parse data size less than struct")
-	}
+func (d *DynImgHdr) SetSecondAddr(v uint32) {
+	set32(d.second_addr, v)
+}
 
-	buf := bytes.NewReader(data)
-	err := binary.Read(buf, binary.LittleEndian, &d.Raw)
-	if err != nil {
-		log.Fatalln(err)
-	}
+func (d *DynImgHdr) TagsAddr() uint32 {
+	return get32(d.tags_addr)
+}
 
-	// copy data
-	d.HdrPxa = d.Raw
+func (d *DynImgHdr) SetTagsAddr(v uint32) {
+	set32(d.tags_addr, v)
+}
 
-	d.ExtraSize = &d.HdrPxa.ExtraSize
-	d.Name = &d.HdrPxa.Name
-	d.Cmdline = &d.HdrPxa.Cmdline
-	d.Id = &d.HdrPxa.Id
-	d.ExtraCmdline = &d.HdrPxa.ExtraCmdline
+func (d *DynImgHdr) DtbAddr() uint64 {
+	return get64(d.dtb_addr)
 }
 
-type DynImgV3 struct {
-	DynImgHdrBoot
+func (d *DynImgHdr) SetDtbAddr(v uint64) {
+	set64(d.dtb_addr, v)
+}
 
-	Raw BootImgHdrV3
+func (d *DynImgHdr) Name() []byte {
+	return d.name
+}
 
-	KernelSize   *uint32
-	RamdiskSize  *uint32
-	OsVersion    *uint32
-	HeaderSize   *uint32
-	Cmdline      *[1536]byte
-	ExtraCmdline *[1536 - BOOT_ARGS_SIZE]byte
+// Name is always kept null terminated
+func (d *DynImgHdr) SetName(name string) {
+	if d.name != nil {
+		clear(d.name)
+		copy(d.name[:len(d.name)-1], name)
+	}
 }
 
-func (d *DynImgV3) HeaderVersion() uint32 {
-	return d.V4Hdr.HeaderVersion
+func (d *DynImgHdr) Cmdline() []byte {
+	return d.cmdline
 }
 
-func (d *DynImgV3) PageSize() uint32 {
-	return 4096
+func (d *DynImgHdr) ExtraCmdline() []byte {
+	return d.extra_cmdline
 }
 
-func (d *DynImgV3) Init(data []byte) {
-	if len(data) < binary.Size(d.Raw) {
-		log.Fatalln("Error: Could not parse data size less than struct")
+func (d *DynImgHdr) SetCmdline(cmdline string) {
+	clear(d.cmdline)
+	n := copy(d.cmdline, cmdline)
+	if d.extra_cmdline != nil {
+		clear(d.extra_cmdline)
+		copy(d.extra_cmdline, cmdline[n:])
 	}
+}
 
-	buf := bytes.NewReader(data)
-	err := binary.Read(buf, binary.LittleEndian, &d.Raw)
-	if err != nil {
-		log.Fatalln(err)
+func (d *DynImgHdr) Id() []byte {
+	return d.id
+}
+
+func (d *DynImgHdr) SetId(id []byte) {
+	if d.id != nil {
+		clear(d.id)
+		copy(d.id, id)
 	}
+}
 
-	// copy data
-	d.V4Hdr.BootImgHdrV3 = d.Raw
+func decodeOsVersion(os_ver uint32) (a, b, c, y, m uint32) {
+	version := os_ver >> 11
+	patch_level := os_ver & 0x7ff
 
-	d.KernelSize = &d.V4Hdr.HeaderSize
-	d.RamdiskSize = &d.V4Hdr.RamdiskSize
-	d.OsVersion = &d.V4Hdr.OsVersion
-	d.HeaderSize = &d.V4Hdr.HeaderSize
-	d.Cmdline = &d.V4Hdr.Cmdline
-	d.ExtraCmdline = (*[1536 - BOOT_ARGS_SIZE]byte)(unsafe.Pointer(&d.V4Hdr.Cmdline[BOOT_ARGS_SIZE]))
+	a = (version >> 14) & 0x7f
+	b = (version >> 7) & 0x7f
+	c = version & 0x7f
 
+	y = (patch_level >> 4) + 2000
+	m = patch_level & 0xf
+	return
 }
 
-type DynImgV4 struct {
-	DynImgV3
+func (d *DynImgHdr) Print() {
+	ver := d.HeaderVersion()
+	fmt.Fprintf(os.Stderr, "%-*s [%d]\n", PADDING, "HEADER_VER", ver)
+	if !d.is_vendor {
+		fmt.Fprintf(os.Stderr, "%-*s [%d]\n", PADDING, "KERNEL_SZ", d.KernelSize())
+	}
+	fmt.Fprintf(os.Stderr, "%-*s [%d]\n", PADDING, "RAMDISK_SZ", d.RamdiskSize())
+	if ver < 3 {
+		fmt.Fprintf(os.Stderr, "%-*s [%d]\n", PADDING, "SECOND_SZ", d.SecondSize())
+	}
+	if ver == 0 {
+		fmt.Fprintf(os.Stderr, "%-*s [%d]\n", PADDING, "EXTRA_SZ", d.ExtraSize())
+	}
+	if ver == 1 || ver == 2 {
+		fmt.Fprintf(os.Stderr, "%-*s [%d]\n", PADDING, "RECOV_DTBO_SZ", d.RecoveryDtboSize())
+	}
+	if ver == 2 || d.is_vendor {
+		fmt.Fprintf(os.Stderr, "%-*s [%d]\n", PADDING, "DTB_SZ", d.DtbSize())
+	}
+	if d.is_vendor && ver >= 4 {
+		fmt.Fprintf(os.Stderr, "%-*s [%d]\n", PADDING, "BOOTCONFIG_SZ", d.BootconfigSize())
+	}
+
+	if os_ver := d.OsVersion(); os_ver != 0 {
+		a, b, c, y, m := decodeOsVersion(os_ver)
+		fmt.Fprintf(os.Stderr, "%-*s [%d.%d.%d]\n", PADDING, "OS_VERSION", a, b, c)
+		fmt.Fprintf(os.Stderr, "%-*s [%d-%02d]\n", PADDING, "OS_PATCH_LEVEL", y, m)
+	}
 
-	Raw BootImgHdrV4
+	fmt.Fprintf(os.Stderr, "%-*s [%d]\n", PADDING, "PAGESIZE", d.PageSize())
+	if d.name != nil {
+		fmt.Fprintf(os.Stderr, "%-*s [%s]\n", PADDING, "NAME", cstr(d.name))
+	}
+	fmt.Fprintf(os.Stderr, "%-*s [%s%s]\n", PADDING, "CMDLINE", cstr(d.cmdline), cstr(d.extra_cmdline))
+	if d.id != nil {
+		fmt.Fprintf(os.Stderr, "%-*s [%x]\n", PADDING, "CHECKSUM", d.id)
+	}
 }
 
-func (d *DynImgV4) SignatureSize() uint32 {
-	return d.V4Hdr.SignatureSize
+// Page size of v3/v4 boot image is fixed
+func (d *DynImgHdr) fixedPageSize() bool {
+	return !d.is_vendor && d.HeaderVersion() >= 3
 }
 
-func (d *DynImgV4) Init(data []byte) {
-	if len(data) < binary.Size(d.Raw) {
-		log.Fatalln("Error: Could not parse data size less than struct")
+func (d *DynImgHdr) DumpHdrFile() error {
+	fd, err := os.Create(HEADER_FILE)
+	if err != nil {
+		return err
 	}
+	defer fd.Close()
 
-	buf := bytes.NewReader(data)
-	err := binary.Read(buf, binary.LittleEndian, &d.Raw)
-	if err != nil {
-		log.Fatalln(err)
+	if d.name != nil {
+		fmt.Fprintf(fd, "name=%s\n", cstr(d.name))
+	}
+	fmt.Fprintf(fd, "cmdline=%s%s\n", cstr(d.cmdline), cstr(d.extra_cmdline))
+	if os_ver := d.OsVersion(); os_ver != 0 {
+		a, b, c, y, m := decodeOsVersion(os_ver)
+		fmt.Fprintf(fd, "os_version=%d.%d.%d\n", a, b, c)
+		fmt.Fprintf(fd, "os_patch_level=%d-%02d\n", y, m)
+	}
+	if !d.fixedPageSize() {
+		fmt.Fprintf(fd, "page_size=%d\n", d.PageSize())
+	}
+	return nil
+}
+
+func (d *DynImgHdr) LoadHdrFile() error {
+	return parsePropFile(HEADER_FILE, func(key, value string) error {
+		switch key {
+		case "name":
+			d.SetName(value)
+		case "cmdline":
+			d.SetCmdline(value)
+		case "os_version":
+			var a, b, c uint32
+			if n, _ := fmt.Sscanf(value, "%d.%d.%d", &a, &b, &c); n != 3 || a > 0x7f || b > 0x7f || c > 0x7f {
+				return fmt.Errorf("invalid os version: %s", value)
+			}
+			patch_level := d.OsVersion() & 0x7ff
+			d.SetOsVersion((((a << 14) | (b << 7) | c) << 11) | patch_level)
+		case "os_patch_level":
+			var y, m uint32
+			if n, _ := fmt.Sscanf(value, "%d-%d", &y, &m); n != 2 || y < 2000 || y >= 2128 || m < 1 || m > 12 {
+				return fmt.Errorf("invalid os patch level: %s", value)
+			}
+			y -= 2000
+			os_ver := d.OsVersion() >> 11
+			d.SetOsVersion((os_ver << 11) | (y << 4) | m)
+		case "page_size":
+			if !d.fixedPageSize() {
+				// Blocks are aligned to pages, which must hold the whole header
+				page_size, err := strconv.ParseUint(value, 0, 32)
+				if err != nil || page_size < d.hdr_size || page_size&(page_size-1) != 0 {
+					return fmt.Errorf("invalid page size: %s", value)
+				}
+				d.SetPageSize(uint32(page_size))
+			}
+		}
+		return nil
+	})
+}
+
+// Read the header struct from the start of data
+func readHdr(data []byte, hdr any) error {
+	if len(data) < binary.Size(hdr) {
+		return truncated("%d bytes is less than %T header", len(data), hdr)
 	}
+	return binary.Read(bytes.NewReader(data), binary.LittleEndian, hdr)
+}
 
-	d.DynImgV3.Init(data)
-	// copy data
-	d.V4Hdr = d.Raw
+// Point to fields shared by v0-v2 and PXA headers
+func (d *DynImgHdr) initCommon(common *BootImgHdrV0Common) {
+	d.kernel_size = &common.KernelSize
+	d.kernel_addr = &common.KernelAddr
+	d.ramdisk_size = &common.RamdiskSize
+	d.ramdisk_addr = &common.RamdiskAddr
+	d.second_size = &common.SecondSize
+	d.second_addr = &common.SecondAddr
 }
 
-type DynImgHdrVendor struct {
+type DynImgV0 struct {
 	DynImgHdr
 }
 
-func (d *DynImgHdrVendor) IsVendor() bool {
-	return true
-}
+func (d *DynImgV0) Init(data []byte) error {
+	if err := readHdr(data, &d.v2_hdr.BootImgHdrV0); err != nil {
+		return err
+	}
 
-type DynImgVndV3 struct {
-	DynImgHdrVendor
+	d.initCommon(&d.v2_hdr.BootImgHdrV0Common)
+	d.raw = &d.v2_hdr
+	d.hdr_size = uint64(binary.Size(d.v2_hdr.BootImgHdrV0))
+	d.tags_addr = &d.v2_hdr.TagsAddr
+	d.page_size = &d.v2_hdr.PageSize
+	// Samsung use header_version as extra_size
+	d.extra_size = &d.v2_hdr.HeaderVersion
+	d.os_version = &d.v2_hdr.OsVersion
+	d.name = d.v2_hdr.Name[:]
+	d.cmdline = d.v2_hdr.Cmdline[:]
+	d.id = d.v2_hdr.Id[:]
+	d.extra_cmdline = d.v2_hdr.ExtraCmdline[:]
+	return nil
+}
 
-	RamdiskSize *uint32
-	Cmdline     *[2048]byte
-	Name        *[16]byte
-	HeaderSize  *uint32
-	DtbSize     *uint32
+type DynImgV1 struct {
+	DynImgV0
+}
 
-	Raw BootImgHdrVndV3
+func (d *DynImgV1) Init(data []byte) error {
+	if err := d.DynImgV0.Init(data); err != nil {
+		return err
+	}
+	if err := readHdr(data, &d.v2_hdr.BootImgHdrV1); err != nil {
+		return err
+	}
 
-	ExtraCmdline *[1536 - BOOT_ARGS_SIZE]byte
+	d.hdr_size = uint64(binary.Size(d.v2_hdr.BootImgHdrV1))
+	d.header_version = &d.v2_hdr.HeaderVersion
+	d.extra_size = nil
+	d.recovery_dtbo_size = &d.v2_hdr.RecoveryDtboSize
+	d.recovery_dtbo_offset = &d.v2_hdr.RecoveryDtboOffset
+	d.header_size = &d.v2_hdr.HeaderSize
+	return nil
 }
 
-func (d *DynImgVndV3) HeaderVersion() uint32 {
-	return d.V4Vnd.HeaderVersion
+type DynImgV2 struct {
+	DynImgV1
 }
 
-func (d *DynImgVndV3) PageSize() uint32 {
-	return d.V4Vnd.PageSize
+func (d *DynImgV2) Init(data []byte) error {
+	if err := d.DynImgV1.Init(data); err != nil {
+		return err
+	}
+	if err := readHdr(data, &d.v2_hdr); err != nil {
+		return err
+	}
+
+	d.hdr_size = uint64(binary.Size(d.v2_hdr))
+	d.dtb_size = &d.v2_hdr.DtbSize
+	d.dtb_addr = &d.v2_hdr.DtbAddr
+	return nil
 }
 
-func (d *DynImgVndV3) HdrSpace() uint64 {
-	return align_to(d.HdrSize(), uint64(d.PageSize()))
+type DynImgPxa struct {
+	DynImgHdr
 }
 
-func (d *DynImgVndV3) Init(data []byte) {
-	if len(data) < binary.Size(d.Raw) {
-		log.Fatalln("Error: Could not parse data size less than struct")
+func (d *DynImgPxa) Init(data []byte) error {
+	if err := readHdr(data, &d.hdr_pxa); err != nil {
+		return err
 	}
 
-	buf := bytes.NewReader(data)
-	err := binary.Read(buf, binary.LittleEndian, &d.Raw)
-	if err != nil {
-		log.Fatalln(err)
-	}
+	d.initCommon(&d.hdr_pxa.BootImgHdrV0Common)
+	d.raw = &d.hdr_pxa
+	d.hdr_size = uint64(binary.Size(d.hdr_pxa))
+	d.tags_addr = &d.hdr_pxa.TagsAddr
+	d.page_size = &d.hdr_pxa.PageSize
+	d.extra_size = &d.hdr_pxa.ExtraSize
+	d.name = d.hdr_pxa.Name[:]
+	d.cmdline = d.hdr_pxa.Cmdline[:]
+	d.id = d.hdr_pxa.Id[:]
+	d.extra_cmdline = d.hdr_pxa.ExtraCmdline[:]
+	return nil
+}
 
-	d.RamdiskSize = &d.Raw.RamdiskSize
-	d.Cmdline = &d.Raw.Cmdline
-	d.Name = &d.Raw.Name
-	d.HeaderSize = &d.Raw.HeaderSize
-	d.DtbSize = &d.Raw.DtbSize
+type DynImgV3 struct {
+	DynImgHdr
 
-	// copy data
-	d.V4Vnd.BootImgHdrVndV3 = d.Raw
+	// Page size is fixed at 4096 bytes
+	fixed_page_size uint32
 }
 
-type DynImgVndV4 struct {
-	DynImgVndV3
+func (d *DynImgV3) Init(data []byte) error {
+	if err := readHdr(data, &d.v4_hdr.BootImgHdrV3); err != nil {
+		return err
+	}
+
+	d.raw = &d.v4_hdr
+	d.hdr_size = uint64(binary.Size(d.v4_hdr.BootImgHdrV3))
+	d.fixed_page_size = 4096
+	d.page_size = &d.fixed_page_size
+	d.header_version = &d.v4_hdr.HeaderVersion
+	d.kernel_size = &d.v4_hdr.KernelSize
+	d.ramdisk_size = &d.v4_hdr.RamdiskSize
+	d.os_version = &d.v4_hdr.OsVersion
+	d.header_size = &d.v4_hdr.HeaderSize
+	d.cmdline = d.v4_hdr.Cmdline[:BOOT_ARGS_SIZE]
+	d.extra_cmdline = d.v4_hdr.Cmdline[BOOT_ARGS_SIZE:]
+	return nil
+}
+
+type DynImgV4 struct {
+	DynImgV3
+}
 
-	Raw BootImgHdrVndV4
+func (d *DynImgV4) Init(data []byte) error {
+	if err := d.DynImgV3.Init(data); err != nil {
+		return err
+	}
+	if err := readHdr(data, &d.v4_hdr); err != nil {
+		return err
+	}
 
-	BootconfigSize *uint32
+	d.hdr_size = uint64(binary.Size(d.v4_hdr))
+	d.signature_size = &d.v4_hdr.SignatureSize
+	return nil
 }
 
-func (d *DynImgVndV4) VendorRamdiskTableSize() uint32 {
-	return d.V4Vnd.VendorRamdiskTableSize
+type DynImgVndV3 struct {
+	DynImgHdr
 }
 
-func (d *DynImgVndV4) VendorRamdiskTableEntryNum() uint32 {
-	return d.V4Vnd.VendorRamdiskTableEntryNum
+func (d *DynImgVndV3) Init(data []byte) error {
+	if err := readHdr(data, &d.v4_vnd.BootImgHdrVndV3); err != nil {
+		return err
+	}
+
+	d.is_vendor = true
+	d.raw = &d.v4_vnd
+	d.hdr_size = uint64(binary.Size(d.v4_vnd.BootImgHdrVndV3))
+	d.page_size = &d.v4_vnd.PageSize
+	d.header_version = &d.v4_vnd.HeaderVersion
+	d.kernel_addr = &d.v4_vnd.KernelAddr
+	d.ramdisk_size = &d.v4_vnd.RamdiskSize
+	d.ramdisk_addr = &d.v4_vnd.RamdiskAddr
+	d.tags_addr = &d.v4_vnd.TagsAddr
+	d.dtb_addr = &d.v4_vnd.DtbAddr
+	d.cmdline = d.v4_vnd.Cmdline[:]
+	d.name = d.v4_vnd.Name[:]
+	d.header_size = &d.v4_vnd.HeaderSize
+	d.dtb_size = &d.v4_vnd.DtbSize
+	return nil
 }
 
-func (d *DynImgVndV4) VendorRamdiskTableEntrySize() uint32 {
-	return d.V4Vnd.VendorRamdiskTableEntrySize
+type DynImgVndV4 struct {
+	DynImgVndV3
 }
 
-func (d *DynImgVndV4) Init(data []byte) {
-	if len(data) < binary.Size(d.Raw) {
-		log.Fatalln("Error: Could not parse data size less than struct")
+func (d *DynImgVndV4) Init(data []byte) error {
+	if err := d.DynImgVndV3.Init(data); err != nil {
+		return err
+	}
+	if err := readHdr(data, &d.v4_vnd); err != nil {
+		return err
 	}
 
-	buf := bytes.NewReader(data)
-	err := binary.Read(buf, binary.LittleEndian, &d.Raw)
-	if err != nil {
-		log.Fatalln(err)
+	d.hdr_size = uint64(binary.Size(d.v4_vnd))
+	d.vendor_ramdisk_table_size = &d.v4_vnd.VendorRamdiskTableSize
+	d.vendor_ramdisk_table_entry_num = &d.v4_vnd.VendorRamdiskTableEntryNum
+	d.vendor_ramdisk_table_entry_size = &d.v4_vnd.VendorRamdiskTableEntrySize
+	d.bootconfig_size = &d.v4_vnd.BootconfigSize
+	return nil
+}
+
+// PXA headers insert extra_size and an unknown field before tags_addr,
+// so the page_size of v0 lands on the unknown field, which is never a
+// sane page size. Double check the real page size and extra size.
+func isPxaHdr(data []byte) bool {
+	var hdr BootImgHdrPxa
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &hdr); err != nil {
+		return false
+	}
+	// page_size of v0 layout
+	if binary.LittleEndian.Uint32(data[36:]) < 0x02000000 {
+		return false
+	}
+	page_size := uint64(hdr.PageSize)
+	if page_size < 2048 || page_size > 0x20000 || page_size&(page_size-1) != 0 {
+		return false
+	}
+	// All blocks have to fit in the image
+	total := page_size
+	for _, sz := range []uint32{hdr.KernelSize, hdr.RamdiskSize, hdr.SecondSize, hdr.ExtraSize} {
+		total += align_to(uint64(sz), page_size)
 	}
+	return total <= uint64(len(data))
+}
+
+// Create the header variant matching the raw header in data
+func NewDynImgHdr(data []byte) (DynImgHdrInterface, error) {
+	var hdr DynImgHdrInterface
 
-	d.DynImgVndV3.Init(data)
+	switch CheckFmt(data) {
+	case AOSP_VENDOR:
+		// header_version follows the magic
+		if len(data) < BOOT_MAGIC_SIZE+4 {
+			return nil, truncated("vendor boot image header")
+		}
+		switch binary.LittleEndian.Uint32(data[BOOT_MAGIC_SIZE:]) {
+		case 4:
+			hdr = new(DynImgVndV4)
+		default:
+			hdr = new(DynImgVndV3)
+		}
+	case AOSP:
+		// header_version is at the same offset in all versions
+		const ver_off = 40
+		if len(data) < ver_off+4 {
+			return nil, truncated("boot image header")
+		}
+		if isPxaHdr(data) {
+			hdr = new(DynImgPxa)
+			break
+		}
+		switch binary.LittleEndian.Uint32(data[ver_off:]) {
+		case 1:
+			hdr = new(DynImgV1)
+		case 2:
+			hdr = new(DynImgV2)
+		case 3:
+			hdr = new(DynImgV3)
+		case 4:
+			hdr = new(DynImgV4)
+		default:
+			hdr = new(DynImgV0)
+		}
+	default:
+		return nil, badMagic("not a boot image header")
+	}
 
-	d.BootconfigSize = &d.Raw.BootconfigSize
-	// copy data
-	d.V4Vnd = d.Raw
+	if err := hdr.Init(data); err != nil {
+		return nil, err
+	}
+	return hdr, nil
 }
 
 const (
@@ -723,9 +1080,11 @@ type bootFlag int
 type BootImg struct {
 	Map mmap.MMap
 
-	Hdr DynImgHdr
+	Hdr DynImgHdrInterface
+	// Where the boot image header starts in Map
+	HdrAddr []byte
 
-	Flags bootFlag
+	Flags [BOOT_FLAGS_MAX]bool
 
 	K_fmt format_t
 	R_fmt format_t
@@ -747,168 +1106,1356 @@ type BootImg struct {
 	AvbFooter *AvbFooter
 	Vbmeta    *AvbVBMetaImageHeader
 
-	Kernel             *[]byte
-	Ramdisk            *[]byte
-	Second             *[]byte
-	Extra              *[]byte
-	RecoveryDtbo       *[]byte
-	Dtb                *[]byte
-	Signature          *[]byte
-	VendorRamdiskTable *[]byte
-	Bootconfig         *[]byte
+	Kernel             []byte
+	Ramdisk            []byte
+	Second             []byte
+	Extra              []byte
+	RecoveryDtbo       []byte
+	Dtb                []byte
+	Signature          []byte
+	VendorRamdiskTable []byte
+	Bootconfig         []byte
 
 	KernelDtb []byte
 
-	Ignore []byte
-}
-
-func (b BootImg) New(file string) {
-
-}
+	// Where each block starts in Map, recorded by ParseImage
+	Offsets struct {
+		Header             uint64
+		Kernel             uint64
+		Ramdisk            uint64
+		Second             uint64
+		Extra              uint64
+		RecoveryDtbo       uint64
+		Dtb                uint64
+		Signature          uint64
+		VendorRamdiskTable uint64
+		Bootconfig         uint64
+		KernelDtb          uint64
+	}
 
-func (b *BootImg) ParseImage(addr *mmap.MMap, t format_t) {
+	Ignore []byte
 
+	// Truncated copy of the shifted AMONET header which Hdr is parsed from
+	amonet_hdr []byte
 }
 
-func (b *BootImg) CreateHdr(addr mmap.MMap, t format_t) {
+const PADDING = 15
 
+func NewBootImg(file string) (*BootImg, error) {
+	b := new(BootImg)
+	if err := b.New(file); err != nil {
+		return nil, err
+	}
+	return b, nil
 }
 
-func (b *BootImg) GetPayload() []byte {
-	return b.Payload
-}
-
-func (b *BootImg) GetTail() []byte {
-	return b.Tail
-}
+func (b *BootImg) New(file string) error {
+	fmt.Fprintf(os.Stderr, "Parsing boot image: [%s]\n", file)
 
-func (b *BootImg) Verify(cert string) bool {
-	return false // not impl
-}
+	fd, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
 
-func decompress(t format_t, fd *os.File, in mmap.MMap) {
-	decoder := NewDecoder(t, bytes.NewReader(in))
-	io.Copy(fd, decoder)
-}
+	b.Map, err = mmap.Map(fd, mmap.RDONLY, 0)
+	if err != nil {
+		return err
+	}
 
-func dump(buf []byte, size int, filename string) {
-	if size == 0 {
-		return
+	for addr := 0; addr < len(b.Map); addr++ {
+		switch t := CheckFmt(b.Map[addr:]); t {
+		case CHROMEOS:
+			// Skip vboot keyblock and kernel preamble
+			fmt.Fprintln(os.Stderr, "CHROMEOS")
+			b.Flags[CHROMEOS_FLAG] = true
+			addr += CHROMEOS_HDR_SZ - 1
+		case DHTB:
+			fmt.Fprintln(os.Stderr, "DHTB_HDR")
+			b.Flags[DHTB_FLAG] = true
+			b.Flags[SEANDROID_FLAG] = true
+			addr += DHTB_HDR_SZ - 1
+		case BLOB:
+			if _, start, ok := findBlobLnx(b.Map[addr:]); ok {
+				fmt.Fprintln(os.Stderr, "TEGRA_BLOB")
+				b.Flags[BLOB_FLAG] = true
+				addr += int(start) - 1
+			}
+		case AOSP, AOSP_VENDOR:
+			if err = b.ParseImage(b.Map[addr:], t); err == nil {
+				return nil
+			}
+			fmt.Fprintf(os.Stderr, "! Skip boot image at 0x%x: %v\n", addr, err)
+		}
 	}
-	fd, err := os.Create(filename)
+	b.Close()
 	if err != nil {
-		log.Fatalln(err)
+		return fmt.Errorf("no valid boot image found in %s: %w", file, err)
 	}
-	defer fd.Close()
-	io.CopyN(fd, bytes.NewReader(buf), int64(size))
+	return badMagic("no valid boot image found in %s", file)
 }
 
-type fdtHeader struct {
-	Magis           uint32
-	TotalSize       uint32
-	OffDtStruct     uint32
-	OffDtStrings    uint32
-	OffMemRsvmap    uint32
-	Version         uint32
-	LastCompVersion uint32
-	BootCpuidPhys   uint32
-	SizeDtStrings   uint32
-	SizeDtStruct    uint32
+func (b *BootImg) Close() {
+	b.Map.Unmap()
 }
 
-//type nodeHeader struct {
-//	Tag  uint32
-//	Name []byte
-//}
+func (b *BootImg) ParseImage(addr []byte, t format_t) error {
+	hdr, err := b.CreateHdr(addr)
+	if err != nil {
+		return err
+	}
+	b.Hdr = hdr
+
+	base := b.HdrAddr
+	// HdrAddr always runs to the end of Map
+	base_off := uint64(len(b.Map) - len(base))
+	off := b.Hdr.HdrSpace()
+	page_size := uint64(b.Hdr.PageSize())
+	if page_size == 0 {
+		return unsupported("page size 0")
+	}
 
-func findDtbOffset(fmap mmap.MMap, sz uint32) int {
-	fmap_idx := 0
-	end := fmap_idx + int(sz)
+	b.Offsets.Header = base_off
+	if b.Flags[AMONET_FLAG] {
+		b.Offsets.Header += AMONET_MICROLOADER_SZ
+	}
 
-	for curr := fmap_idx; curr < fmap_idx+int(sz); curr += 40 {
-		curr = bytes.Index(fmap, []byte{0xd0, 0x0d, 0xfe, 0xed})
-		if curr == -1 {
-			return -1
+	corrupted := false
+	get_block := func(sz uint32, blk_off *uint64) []byte {
+		if corrupted || off+uint64(sz) > uint64(len(base)) {
+			corrupted = true
+			return nil
 		}
-		fdt_hdr := fdtHeader{}
-		binary.Read(bytes.NewReader(fmap[curr:]), binary.BigEndian, &fdt_hdr)
+		blk := base[off : off+uint64(sz)]
+		*blk_off = base_off + off
+		off = align_to(off+uint64(sz), page_size)
+		return blk
+	}
 
-		totalsize := fdt_hdr.TotalSize
-		if totalsize > uint32(end-curr) {
-			continue
+	if id := b.Hdr.Id(); id != nil {
+		for _, c := range id[sha1.Size+4 : sha256.Size] {
+			if c != 0 {
+				b.Flags[SHA256_FLAG] = true
+				break
+			}
 		}
+	}
 
-		off_dt_struct := fdt_hdr.OffDtStruct
-		if off_dt_struct > uint32(end-curr) {
-			continue
+	b.Hdr.Print()
+
+	b.Kernel = get_block(b.Hdr.KernelSize(), &b.Offsets.Kernel)
+	b.Ramdisk = get_block(b.Hdr.RamdiskSize(), &b.Offsets.Ramdisk)
+	b.Second = get_block(b.Hdr.SecondSize(), &b.Offsets.Second)
+	b.Extra = get_block(b.Hdr.ExtraSize(), &b.Offsets.Extra)
+	b.RecoveryDtbo = get_block(b.Hdr.RecoveryDtboSize(), &b.Offsets.RecoveryDtbo)
+	b.Dtb = get_block(b.Hdr.DtbSize(), &b.Offsets.Dtb)
+	b.Signature = get_block(b.Hdr.SignatureSize(), &b.Offsets.Signature)
+	b.VendorRamdiskTable = get_block(b.Hdr.VendorRamdiskTableSize(), &b.Offsets.VendorRamdiskTable)
+	b.Bootconfig = get_block(b.Hdr.BootconfigSize(), &b.Offsets.Bootconfig)
+
+	if corrupted {
+		return truncated("boot image blocks exceed %d bytes", len(base))
+	}
+
+	off = min(off, uint64(len(base)))
+	b.Payload = base[:off]
+	b.Tail = base[off:]
+
+	if sz := b.Hdr.KernelSize(); sz != 0 {
+		if dtb_off := findDtbOffset(b.Kernel); dtb_off > 0 {
+			b.KernelDtb = b.Kernel[dtb_off:]
+			b.Kernel = b.Kernel[:dtb_off]
+			b.Offsets.KernelDtb = b.Offsets.Kernel + uint64(dtb_off)
+			b.Hdr.SetKernelSize(uint32(dtb_off))
+			fmt.Fprintf(os.Stderr, "%-*s [%d]\n", PADDING, "KERNEL_DTB_SZ", len(b.KernelDtb))
 		}
 
-		var fdt_node_hdr_tag uint32
-		binary.Read(bytes.NewReader(fmap[curr+int(off_dt_struct):]), binary.BigEndian, &fdt_node_hdr_tag)
-		if fdt_node_hdr_tag != 0x1 {
-			continue
+		b.K_fmt = checkFmtLg(b.Kernel, uint64(b.Hdr.KernelSize()))
+		if b.K_fmt == MTK && len(b.Kernel) >= MTK_HDR_SZ {
+			fmt.Fprintln(os.Stderr, "MTK_KERNEL_HDR")
+			b.Flags[MTK_KERNEL] = true
+			b.K_hdr = parseMtkHdr(b.Kernel)
+			b.Kernel = b.Kernel[MTK_HDR_SZ:]
+			b.Offsets.Kernel += MTK_HDR_SZ
+			b.Hdr.SetKernelSize(b.Hdr.KernelSize() - MTK_HDR_SZ)
+			b.K_fmt = checkFmtLg(b.Kernel, uint64(b.Hdr.KernelSize()))
 		}
-		return curr - fmap_idx
+		if b.K_fmt == ZIMAGE {
+			b.parseZimage()
+		}
+		fmt.Fprintf(os.Stderr, "%-*s [%s]\n", PADDING, "KERNEL_FMT", Fmt2Name(b.K_fmt))
+	}
+	if num := b.Hdr.VendorRamdiskTableEntryNum(); num != 0 {
+		// v4 vendor boot contains multiple ramdisks
+		b.R_fmt = UNKNOWN
+		entry_size := b.Hdr.VendorRamdiskTableEntrySize()
+		if entry_size < uint32(binary.Size(VendorRamdiskTableEntryV4{})) {
+			return unsupported("vendor ramdisk table entry size %d", entry_size)
+		}
+		if uint64(num)*uint64(entry_size) > uint64(len(b.VendorRamdiskTable)) {
+			return truncated("%d vendor ramdisk table entries exceed table size %d", num, len(b.VendorRamdiskTable))
+		}
+		for _, it := range b.VendorRamdiskEntries() {
+			if uint64(it.RamdiskOffset)+uint64(it.RamdiskSize) > uint64(len(b.Ramdisk)) {
+				return truncated("vendor ramdisk %s exceeds ramdisk", cstr(it.RamdiskName[:]))
+			}
+			fmt.Fprintf(os.Stderr, "%-*s name=[%s] type=[%s] size=[%d] fmt=[%s]\n",
+				PADDING, "VND_RAMDISK",
+				cstr(it.RamdiskName[:]),
+				vendorRamdiskType(it.RamdiskType),
+				it.RamdiskSize,
+				Fmt2Name(checkFmtLg(b.Ramdisk[it.RamdiskOffset:], uint64(it.RamdiskSize))),
+			)
+		}
+	} else if sz := b.Hdr.RamdiskSize(); sz != 0 {
+		b.R_fmt = checkFmtLg(b.Ramdisk, uint64(sz))
+		if b.R_fmt == MTK && len(b.Ramdisk) >= MTK_HDR_SZ {
+			fmt.Fprintln(os.Stderr, "MTK_RAMDISK_HDR")
+			b.Flags[MTK_RAMDISK] = true
+			b.R_hdr = parseMtkHdr(b.Ramdisk)
+			b.Ramdisk = b.Ramdisk[MTK_HDR_SZ:]
+			b.Offsets.Ramdisk += MTK_HDR_SZ
+			b.Hdr.SetRamdiskSize(b.Hdr.RamdiskSize() - MTK_HDR_SZ)
+			b.R_fmt = checkFmtLg(b.Ramdisk, uint64(b.Hdr.RamdiskSize()))
+		}
+		fmt.Fprintf(os.Stderr, "%-*s [%s]\n", PADDING, "RAMDISK_FMT", Fmt2Name(b.R_fmt))
+	}
+	if sz := b.Hdr.ExtraSize(); sz != 0 {
+		b.E_fmt = checkFmtLg(b.Extra, uint64(sz))
+		fmt.Fprintf(os.Stderr, "%-*s [%s]\n", PADDING, "EXTRA_FMT", Fmt2Name(b.E_fmt))
 	}
-	return -1
-}
-
-func checkFmtLg(fmap mmap.MMap, sz uint32) format_t {
-	f := CheckFmt(fmap)
 
-	reader := bytes.NewReader(fmap)
+	// Check tail info
+	if len(b.Tail) > 0 {
+		// Check special flags
+		if bytes.HasPrefix(b.Tail, []byte(SEANDROID_MAGIC)) {
+			fmt.Fprintln(os.Stderr, "SAMSUNG_SEANDROID")
+			b.Flags[SEANDROID_FLAG] = true
+		} else if bytes.HasPrefix(b.Tail, []byte(LG_BUMP_MAGIC)) {
+			fmt.Fprintln(os.Stderr, "LG_BUMP_IMAGE")
+			b.Flags[LG_BUMP_FLAG] = true
+		} else if verifyBootSignature(b.Payload, b.Tail, nil) == nil {
+			fmt.Fprintln(os.Stderr, "AVB1_SIGNED")
+			b.Flags[AVB1_SIGNED_FLAG] = true
+		}
 
-	if f == LZ4_LEGACY {
-		var off int64 = 4 // seems skip lz4_legacy header bytes
-		var block_sz uint32
-		for {
-			if off+4 < int64(sz) {
-				reader.Seek(int64(off), io.SeekStart)
-				binary.Read(reader, binary.LittleEndian, &block_sz)
-				off += 4
-				if off+int64(block_sz) > int64(sz) {
-					return LZ4_LG
+		// Find AVB footer
+		if footer_sz := binary.Size(AvbFooter{}); len(b.Tail) >= footer_sz {
+			footer := b.Tail[len(b.Tail)-footer_sz:]
+			if bytes.HasPrefix(footer, []byte(AVB_FOOTER_MAGIC)) {
+				b.AvbFooter = new(AvbFooter)
+				binary.Read(bytes.NewReader(footer), binary.BigEndian, b.AvbFooter)
+				// Double check if vbmeta header exists
+				if meta := b.VbmetaData(); meta != nil {
+					fmt.Fprintln(os.Stderr, "VBMETA")
+					b.Flags[AVB_FLAG] = true
+					b.Vbmeta = new(AvbVBMetaImageHeader)
+					binary.Read(bytes.NewReader(meta), binary.BigEndian, b.Vbmeta)
 				}
-				off += int64(block_sz)
 			}
 		}
 	}
-	return f
+
+	return nil
 }
 
-func SplitImageDtb(filename string, skip_decomp bool) int {
-	file, err := os.OpenFile(filename, os.O_RDONLY, 0644)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	fmap, err := mmap.Map(file, 0, mmap.RDONLY)
-	if err != nil {
-		file.Close()
-		log.Fatalln(err)
+// Locate the compressed piggy in an ARM zImage kernel
+// and strip the zImage decompressor around it
+func (b *BootImg) parseZimage() {
+	kernel := b.Kernel
+	size := b.Hdr.KernelSize()
+	z_hdr_sz := uint32(binary.Size(ZimageHdr{}))
+	if size < z_hdr_sz {
+		fmt.Fprintln(os.Stderr, "! zImage header is truncated, keeping raw kernel")
+		return
 	}
-	defer fmap.Unmap()
-	defer file.Close()
+	b.Z_hdr = new(ZimageHdr)
+	binary.Read(bytes.NewReader(kernel), binary.LittleEndian, b.Z_hdr)
 
-	st, _ := os.Stat(filename)
-	img_sz := uint32(st.Size()) // i have not seen big file kernel + dtb
-	if off := findDtbOffset(fmap, img_sz); off > 0 {
-		f := checkFmtLg(fmap, uint32(img_sz))
-		if !skip_decomp && COMPRESSED(f) {
-			fd, err := os.Create(KERNEL_FILE)
-			if err != nil {
-				log.Fatalln(err)
+	hdr_sz := z_hdr_sz
+	for ; hdr_sz < size; hdr_sz++ {
+		if isZimagePiggy(kernel[hdr_sz:size]) {
+			break
+		}
+	}
+	if hdr_sz == size {
+		fmt.Fprintln(os.Stderr, "! Could not find zImage piggy, keeping raw kernel")
+		return
+	}
+	fmt.Fprintln(os.Stderr, "ZIMAGE_KERNEL")
+	b.ZInfo.HdrSz = hdr_sz
+
+	// Find end of piggy, its offset is one of the last entries in the GOT
+	zimage_sz := b.Z_hdr.End - b.Z_hdr.Start
+	piggy_end := zimage_sz
+	if zimage_sz > 0xFF && zimage_sz <= size {
+		var offsets [16]uint32
+		binary.Read(bytes.NewReader(kernel[zimage_sz-uint32(binary.Size(offsets)):]), binary.LittleEndian, &offsets)
+		for i := len(offsets) - 1; i >= 0; i-- {
+			if offsets[i] > zimage_sz-0xFF && offsets[i] < zimage_sz {
+				piggy_end = offsets[i]
+				break
 			}
-			decompress(f, fd, fmap[off:])
-			fd.Close()
-		} else {
-			dump(fmap, off, KERNEL_FILE)
 		}
-		dump(fmap[off:], int(img_sz)-off, KER_DTB_FILE)
-	} else {
-		fmt.Fprintln(os.Stderr, "Cannot find DTB in", filename)
-		return 1
+	}
+	if piggy_end == zimage_sz || piggy_end <= hdr_sz {
+		fmt.Fprintln(os.Stderr, "! Could not find end of zImage piggy, keeping raw kernel")
+		return
 	}
 
-	return 0
-
+	b.Flags[ZIMAGE_KERNEL] = true
+	b.ZInfo.Tail = kernel[piggy_end:size]
+	b.Kernel = kernel[hdr_sz:piggy_end]
+	b.Offsets.Kernel += uint64(hdr_sz)
+	b.Hdr.SetKernelSize(piggy_end - hdr_sz)
+	b.K_fmt = checkFmtLg(b.Kernel, uint64(b.Hdr.KernelSize()))
+}
+
+// Whether the zImage piggy starts at data.
+// Short magics could show up by chance in the decompressor code,
+// so the start of the stream has to decode as well.
+func isZimagePiggy(data []byte) bool {
+	f := checkFmtLg(data, uint64(len(data)))
+	if f == LZOP {
+		// lzop cannot be decoded, check its full signature instead
+		return bytes.HasPrefix(data, []byte(LZOP_MAGIC+"\x00\r\n\x1a\n"))
+	}
+	if !COMPRESSED(f) {
+		return false
+	}
+	if f == LZMA && binary.LittleEndian.Uint32(data[1:]) > 64<<20 {
+		// Kernels are packed with at most lzma -9, skip before allocating the dictionary
+		return false
+	}
+	decoder, err := NewDecoder(f, bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	defer decoder.Close()
+	_, err = io.ReadFull(decoder, make([]byte, 64))
+	return err == nil
+}
+
+// Locate the LNX partition in tegra blob,
+// returns the offsets of its partition entry and its data
+func findBlobLnx(data []byte) (entry, start uint64, ok bool) {
+	var hdr BlobHdr
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &hdr); err != nil {
+		return 0, 0, false
+	}
+	part_sz := uint64(binary.Size(BlobPart{}))
+	for i := range uint64(hdr.NumParts) {
+		entry = BLOB_SECURE_HDR_SZ + uint64(hdr.PartOffset) + i*part_sz
+		if entry+part_sz > uint64(len(data)) {
+			break
+		}
+		var part BlobPart
+		binary.Read(bytes.NewReader(data[entry:]), binary.LittleEndian, &part)
+		if cstr(part.Name[:]) == "LNX" {
+			start = BLOB_SECURE_HDR_SZ + uint64(part.Offset)
+			return entry, start, start+uint64(part.Size) <= uint64(len(data))
+		}
+	}
+	return 0, 0, false
+}
+
+// Parse and print the MTK header at the start of data
+func parseMtkHdr(data []byte) *MtkHdr {
+	hdr := new(MtkHdr)
+	binary.Read(bytes.NewReader(data), binary.LittleEndian, hdr)
+	fmt.Fprintf(os.Stderr, "%-*s [%d]\n", PADDING, "SIZE", hdr.Size)
+	fmt.Fprintf(os.Stderr, "%-*s [%s]\n", PADDING, "NAME", cstr(hdr.Name[:]))
+	return hdr
+}
+
+func (b *BootImg) CreateHdr(addr []byte) (DynImgHdrInterface, error) {
+	hdr, err := NewDynImgHdr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.IsVendor() {
+		fmt.Fprintln(os.Stderr, "VENDOR_BOOT_HDR")
+		b.HdrAddr = addr
+		return hdr, nil
+	}
+	if _, ok := hdr.(*DynImgPxa); ok {
+		fmt.Fprintln(os.Stderr, "PXA_BOOT_HDR")
+		b.HdrAddr = addr
+		return hdr, nil
+	}
+
+	// For NOOKHD and ACCLAIM, the entire boot image is shifted by a fixed offset.
+	// For AMONET, only the header is internally shifted by a fixed offset.
+
+	if len(addr) > AMONET_MICROLOADER_SZ &&
+		bytes.Contains(addr[:AMONET_MICROLOADER_SZ], []byte(AMONET_MICROLOADER_MAGIC)) &&
+		bytes.HasPrefix(addr[AMONET_MICROLOADER_SZ:], []byte(BOOT_MAGIC)) {
+		// The real header is shifted and truncated at the page boundary,
+		// copy to temporary buffer. Blocks are still aligned to addr.
+		if hdr, err = NewDynImgHdr(addr[AMONET_MICROLOADER_SZ:]); err != nil {
+			return nil, err
+		}
+		page_size := uint64(hdr.PageSize())
+		if page_size <= AMONET_MICROLOADER_SZ {
+			return nil, unsupported("page size %d with AMONET microloader", page_size)
+		}
+		if page_size > uint64(len(addr)) {
+			return nil, truncated("AMONET header page size %d", page_size)
+		}
+		buf := make([]byte, page_size)
+		copy(buf, addr[AMONET_MICROLOADER_SZ:page_size])
+		if hdr, err = NewDynImgHdr(buf); err != nil {
+			return nil, err
+		}
+		fmt.Fprintln(os.Stderr, "AMONET_MICROLOADER")
+		b.Flags[AMONET_FLAG] = true
+		b.Ignore = addr[:AMONET_MICROLOADER_SZ]
+		b.HdrAddr = addr
+		b.amonet_hdr = buf
+		return hdr, nil
+	}
+
+	cmd_match := func(magic string) bool {
+		return bytes.HasPrefix(hdr.Cmdline(), []byte(magic))
+	}
+	pre_sz := 0
+	if cmd_match(NOOKHD_RL_MAGIC) || cmd_match(NOOKHD_GL_MAGIC) || cmd_match(NOOKHD_GR_MAGIC) ||
+		cmd_match(NOOKHD_EB_MAGIC) || cmd_match(NOOKHD_ER_MAGIC) {
+		fmt.Fprintln(os.Stderr, "NOOKHD_LOADER")
+		b.Flags[NOOKHD_FLAG] = true
+		pre_sz = NOOKHD_PRE_HEADER_SZ
+	} else if bytes.HasPrefix(hdr.Name(), []byte(ACCLAIM_MAGIC)) {
+		fmt.Fprintln(os.Stderr, "ACCLAIM_LOADER")
+		b.Flags[ACCLAIM_FLAG] = true
+		pre_sz = ACCLAIM_PRE_HEADER_SZ
+	}
+	if pre_sz != 0 {
+		// The real boot image follows the loader
+		if len(addr) <= pre_sz {
+			return nil, truncated("%d bytes is less than pre-header", len(addr))
+		}
+		if hdr, err = NewDynImgHdr(addr[pre_sz:]); err != nil {
+			return nil, err
+		}
+		b.Ignore = addr[:pre_sz]
+		addr = addr[pre_sz:]
+	}
+
+	b.HdrAddr = addr
+	return hdr, nil
+}
+
+// The original zImage in the kernel block, starting with its header
+func (b *BootImg) zimage() []byte {
+	off := b.Hdr.HdrSpace()
+	if b.Flags[MTK_KERNEL] {
+		off += MTK_HDR_SZ
+	}
+	return b.HdrAddr[off:]
+}
+
+// Where the real boot image header starts in Map
+func (b *BootImg) rawHdr() []byte {
+	if b.Flags[AMONET_FLAG] {
+		return b.HdrAddr[AMONET_MICROLOADER_SZ:]
+	}
+	return b.HdrAddr
+}
+
+// Parse entries in vendor ramdisk table, v4 vendor boot only
+func (b *BootImg) VendorRamdiskEntries() []VendorRamdiskTableEntryV4 {
+	num := b.Hdr.VendorRamdiskTableEntryNum()
+	entry_size := uint64(b.Hdr.VendorRamdiskTableEntrySize())
+	entries := make([]VendorRamdiskTableEntryV4, 0, num)
+
+	for i := uint64(0); i < uint64(num); i++ {
+		if (i+1)*entry_size > uint64(len(b.VendorRamdiskTable)) {
+			break
+		}
+		it := VendorRamdiskTableEntryV4{}
+		binary.Read(bytes.NewReader(b.VendorRamdiskTable[i*entry_size:]), binary.LittleEndian, &it)
+		entries = append(entries, it)
+	}
+	return entries
+}
+
+func vendorRamdiskType(t uint32) string {
+	switch t {
+	case VENDOR_RAMDISK_TYPE_NONE:
+		return "none"
+	case VENDOR_RAMDISK_TYPE_PLATFORM:
+		return "platform"
+	case VENDOR_RAMDISK_TYPE_RECOVERY:
+		return "recovery"
+	case VENDOR_RAMDISK_TYPE_DLKM:
+		return "dlkm"
+	default:
+		return "unknown"
+	}
+}
+
+// File name of a vendor ramdisk fragment in VND_RAMDISK_DIR
+func vendorRamdiskFile(name []byte) string {
+	if n := cstr(name); n != "" {
+		return n + ".cpio"
+	}
+	return RAMDISK_FILE
+}
+
+// Save type and board_id of each vendor ramdisk, so the table
+// could be rebuilt on repack
+func dumpVendorRamdiskTable(entries []VendorRamdiskTableEntryV4) error {
+	fd, err := os.Create(VND_RAMDISK_TBL)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	for _, it := range entries {
+		board_id := make([]string, len(it.BoardId))
+		for i, id := range it.BoardId {
+			board_id[i] = fmt.Sprintf("0x%08x", id)
+		}
+		if _, err := fmt.Fprintf(fd, "name=%s type=%d board_id=%s\n",
+			cstr(it.RamdiskName[:]), it.RamdiskType, strings.Join(board_id, ",")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The raw vbmeta image pointed to by the AVB footer, nil if not exists
+func (b *BootImg) VbmetaData() []byte {
+	if b.AvbFooter == nil {
+		return nil
+	}
+	off, size := b.AvbFooter.VbmetaOffset, b.AvbFooter.VbmetaSize
+	if size < uint64(binary.Size(AvbVBMetaImageHeader{})) ||
+		off > uint64(len(b.HdrAddr)) || size > uint64(len(b.HdrAddr))-off {
+		return nil
+	}
+	meta := b.HdrAddr[off : off+size]
+	if !bytes.HasPrefix(meta, []byte(AVB_MAGIC)) {
+		return nil
+	}
+	return meta
+}
+
+func (b *BootImg) GetPayload() []byte {
+	return b.Payload
+}
+
+func (b *BootImg) GetTail() []byte {
+	return b.Tail
+}
+
+// Decompress in with format t into fd.
+// Trailing data after the compressed stream, like padding, is ignored.
+func decompress(t format_t, fd io.Writer, in []byte) error {
+	decoder, err := NewDecoder(t, bytes.NewReader(in))
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+	w := &countWriter{writer: fd}
+	if _, err := io.Copy(w, decoder); err != nil {
+		if w.err != nil {
+			return w.err
+		}
+		return fmt.Errorf("%w: %s stream: %w", ErrTruncated, Fmt2Name(t), err)
+	}
+	return nil
+}
+
+func dump(buf []byte, size int, filename string) error {
+	if size == 0 {
+		return nil
+	}
+	return os.WriteFile(filename, buf[:size], 0644)
+}
+
+// Dump data into filename, decompress it on-the-fly if it is compressed
+func dumpBlock(data []byte, t format_t, skip_decomp bool, filename string) error {
+	if skip_decomp || !COMPRESSED(t) || len(data) == 0 {
+		return dump(data, len(data), filename)
+	}
+	fd, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := decompress(t, fd, data); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+func checkFmtLg(fmap mmap.MMap, sz uint64) format_t {
+	f := CheckFmt(fmap)
+
+	reader := bytes.NewReader(fmap)
+
+	if f == LZ4_LEGACY {
+		var off int64 = 4 // seems skip lz4_legacy header bytes
+		var block_sz uint32
+		for off+4 <= int64(sz) {
+			reader.Seek(int64(off), io.SeekStart)
+			binary.Read(reader, binary.LittleEndian, &block_sz)
+			off += 4
+			if off+int64(block_sz) > int64(sz) {
+				return LZ4_LG
+			}
+			off += int64(block_sz)
+		}
+	}
+	return f
+}
+
+// Split a kernel with appended DTBs into kernel and kernel_dtb.
+// If split_all is set, each DTB is also written to kernel_dtb.N
+func SplitImageDtb(filename string, skip_decomp, split_all bool) error {
+	file, err := os.OpenFile(filename, os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fmap, err := mmap.Map(file, 0, mmap.RDONLY)
+	if err != nil {
+		return err
+	}
+	defer fmap.Unmap()
+
+	dtbs := FindDtbs(fmap)
+	if len(dtbs) == 0 || dtbs[0].Offset == 0 {
+		return fmt.Errorf("cannot find DTB in %s", filename)
+	}
+	for i, dtb := range dtbs {
+		name := fmt.Sprintf("%s.%d", KER_DTB_FILE, i)
+		fmt.Fprintf(os.Stderr, "%-*s offset=[0x%x] size=[%d] model=[%s] compatible=[%s]\n",
+			PADDING, name, dtb.Offset, dtb.Size, dtb.Model, strings.Join(dtb.Compatible, ","))
+		if split_all {
+			if err := dump(fmap[dtb.Offset:dtb.Offset+dtb.Size], int(dtb.Size), name); err != nil {
+				return err
+			}
+		}
+	}
+
+	off := dtbs[0].Offset
+	f := checkFmtLg(fmap[:off], off)
+	if err := dumpBlock(fmap[:off], f, skip_decomp, KERNEL_FILE); err != nil {
+		return err
+	}
+	return dump(fmap[off:], len(fmap)-int(off), KER_DTB_FILE)
+}
+
+// Join kernel and kernel_dtb into out_img, the inverse of SplitImageDtb.
+// The kernel is compressed with the format detected in orig_img.
+// If kernel_dtb does not exist, kernel_dtb.N written by split are joined instead
+func MergeImageDtb(orig_img, out_img string, skip_comp bool) error {
+	file, err := os.OpenFile(orig_img, os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fmap, err := mmap.Map(file, 0, mmap.RDONLY)
+	if err != nil {
+		return err
+	}
+	defer fmap.Unmap()
+
+	off := findDtbOffset(fmap)
+	if off < 0 {
+		off = len(fmap)
+	}
+	f := checkFmtLg(fmap[:off], uint64(off))
+	fmt.Fprintf(os.Stderr, "%-*s [%s]\n", PADDING, "KERNEL_FMT", Fmt2Name(f))
+
+	dtbs := []string{KER_DTB_FILE}
+	if !exists(KER_DTB_FILE) {
+		dtbs = nil
+		for i := 0; exists(fmt.Sprintf("%s.%d", KER_DTB_FILE, i)); i++ {
+			dtbs = append(dtbs, fmt.Sprintf("%s.%d", KER_DTB_FILE, i))
+		}
+		if len(dtbs) == 0 {
+			return fmt.Errorf("cannot find %s", KER_DTB_FILE)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Merge to image: [%s]\n", out_img)
+	fd, err := os.Create(out_img)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	size, err := restoreBlock(fd, KERNEL_FILE, f, skip_comp)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%-*s [%d]\n", PADDING, "KERNEL_SZ", size)
+	for _, dtb := range dtbs {
+		size, err := restore(fd, dtb)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%-*s [%d]\n", PADDING, dtb, size)
+	}
+	return fd.Close()
+}
+
+// Unpack image into the current directory.
+// Returns 2 if the image is a ChromeOS kernel partition, otherwise 0.
+func Unpack(image string, skip_decomp bool, hdr bool) (int, error) {
+	boot, err := NewBootImg(image)
+	if err != nil {
+		return 1, err
+	}
+	defer boot.Close()
+
+	if hdr {
+		if err := boot.Hdr.DumpHdrFile(); err != nil {
+			return 1, err
+		}
+	}
+
+	// Dump kernel
+	if err := dumpBlock(boot.Kernel[:boot.Hdr.KernelSize()], boot.K_fmt, skip_decomp, KERNEL_FILE); err != nil {
+		return 1, err
+	}
+
+	// Dump kernel_dtb
+	if err := dump(boot.KernelDtb, len(boot.KernelDtb), KER_DTB_FILE); err != nil {
+		return 1, err
+	}
+
+	// Dump ramdisk
+	if boot.Hdr.VendorRamdiskTableEntryNum() != 0 {
+		// v4 vendor boot image
+		if err := os.MkdirAll(VND_RAMDISK_DIR, 0755); err != nil {
+			return 1, err
+		}
+		for _, it := range boot.VendorRamdiskEntries() {
+			out := filepath.Join(VND_RAMDISK_DIR, vendorRamdiskFile(it.RamdiskName[:]))
+			ramdisk := boot.Ramdisk[it.RamdiskOffset : it.RamdiskOffset+it.RamdiskSize]
+			if err := dumpBlock(ramdisk, checkFmtLg(ramdisk, uint64(it.RamdiskSize)), skip_decomp, out); err != nil {
+				return 1, err
+			}
+		}
+		if err := dumpVendorRamdiskTable(boot.VendorRamdiskEntries()); err != nil {
+			return 1, err
+		}
+	} else if err := dumpBlock(boot.Ramdisk[:boot.Hdr.RamdiskSize()], boot.R_fmt, skip_decomp, RAMDISK_FILE); err != nil {
+		return 1, err
+	}
+
+	// Dump extra
+	if err := dumpBlock(boot.Extra[:boot.Hdr.ExtraSize()], boot.E_fmt, skip_decomp, EXTRA_FILE); err != nil {
+		return 1, err
+	}
+
+	for _, it := range []struct {
+		data []byte
+		file string
+	}{
+		{boot.Second, SECOND_FILE},
+		{boot.RecoveryDtbo, RECV_DTBO_FILE},
+		{boot.Dtb, DTB_FILE},
+		{boot.Bootconfig, BOOTCONFIG_FILE},
+	} {
+		if err := dump(it.data, len(it.data), it.file); err != nil {
+			return 1, err
+		}
+	}
+
+	if boot.Flags[CHROMEOS_FLAG] {
+		return 2, nil
+	}
+	return 0, nil
+}
+
+type countWriter struct {
+	writer io.Writer
+	n      uint64
+	// First error returned by writer
+	err error
+}
+
+func (w *countWriter) Write(data []byte) (int, error) {
+	n, err := w.writer.Write(data)
+	w.n += uint64(n)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// Compress data with format t into fd, return the compressed size
+func compress(t format_t, fd io.Writer, data []byte) (uint64, error) {
+	cw := &countWriter{writer: fd}
+	encoder, err := NewEncoder(t, cw)
+	if err != nil {
+		return 0, err
+	}
+	for len(data) > 0 {
+		n := min(len(data), LZ4_UNCOMPRESSED)
+		if _, err := encoder.Write(data[:n]); err != nil {
+			return cw.n, err
+		}
+		data = data[n:]
+	}
+	if err := encoder.Close(); err != nil {
+		return cw.n, err
+	}
+	return cw.n, nil
+}
+
+func exists(file string) bool {
+	_, err := os.Stat(file)
+	return err == nil
+}
+
+// Copy content of file into fd, return the size copied
+func restore(fd io.Writer, file string) (uint64, error) {
+	in, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	n, err := io.Copy(fd, in)
+	return uint64(n), err
+}
+
+// Write data into fd, compress it with format t if it is not compressed yet
+func writeBlock(fd io.Writer, data []byte, t format_t, skip_comp bool) (uint64, error) {
+	if !skip_comp && !COMPRESSED_ANY(CheckFmt(data)) && COMPRESSED(t) {
+		return compress(t, fd, data)
+	}
+	n, err := fd.Write(data)
+	return uint64(n), err
+}
+
+// Write content of file into fd like writeBlock
+func restoreBlock(fd io.Writer, file string, t format_t, skip_comp bool) (uint64, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	return writeBlock(fd, data, t, skip_comp)
+}
+
+// Load table entries saved by unpack, fallback to the original table
+func loadVendorRamdiskTable(orig []VendorRamdiskTableEntryV4) ([]VendorRamdiskTableEntryV4, error) {
+	data, err := os.ReadFile(VND_RAMDISK_TBL)
+	if err != nil {
+		return slices.Clone(orig), nil
+	}
+
+	entries := make([]VendorRamdiskTableEntryV4, 0)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		it := VendorRamdiskTableEntryV4{}
+		for _, field := range strings.Fields(line) {
+			key, value, _ := strings.Cut(field, "=")
+			switch key {
+			case "name":
+				copy(it.RamdiskName[:VENDOR_RAMDISK_NAME_SIZE-1], value)
+			case "type":
+				t, err := strconv.ParseUint(value, 0, 32)
+				if err != nil {
+					return nil, fmt.Errorf("invalid vendor ramdisk type: %s", value)
+				}
+				it.RamdiskType = uint32(t)
+			case "board_id":
+				for i, id := range strings.Split(value, ",") {
+					if i >= len(it.BoardId) {
+						break
+					}
+					v, err := strconv.ParseUint(id, 0, 32)
+					if err != nil {
+						return nil, fmt.Errorf("invalid vendor ramdisk board_id: %s", id)
+					}
+					it.BoardId[i] = uint32(v)
+				}
+			}
+		}
+		entries = append(entries, it)
+	}
+	return entries, nil
+}
+
+func Repack(src_img, out_img string, skip_comp bool) error {
+	boot, err := NewBootImg(src_img)
+	if err != nil {
+		return err
+	}
+	defer boot.Close()
+	fmt.Fprintf(os.Stderr, "Repack to boot image: [%s]\n", out_img)
+
+	var off struct {
+		header  uint64
+		kernel  uint64
+		ramdisk uint64
+		second  uint64
+		extra   uint64
+		dtb     uint64
+		total   uint64
+		vbmeta  uint64
+	}
+
+	// Create a new boot header and reset sizes
+	hdr_data := boot.rawHdr()
+	if boot.Flags[AMONET_FLAG] {
+		// Bytes past the page boundary belong to the kernel
+		hdr_data = boot.amonet_hdr
+	}
+	hdr, err := NewDynImgHdr(hdr_data)
+	if err != nil {
+		return err
+	}
+	hdr.SetKernelSize(0)
+	hdr.SetRamdiskSize(0)
+	hdr.SetSecondSize(0)
+	hdr.SetExtraSize(0)
+	hdr.SetRecoveryDtboSize(0)
+	hdr.SetRecoveryDtboOffset(0)
+	hdr.SetDtbSize(0)
+	hdr.SetBootconfigSize(0)
+
+	if exists(HEADER_FILE) {
+		if err := hdr.LoadHdrFile(); err != nil {
+			return err
+		}
+	}
+
+	/***************
+	 * Write blocks
+	 ***************/
+
+	fd, err := os.Create(out_img)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	// All blocks are written sequentially through w, the first
+	// write error is kept in w.err and checked after all blocks
+	w := &countWriter{writer: fd}
+	pos := func() uint64 {
+		return w.n
+	}
+	write := func(data []byte) uint64 {
+		if w.err != nil {
+			return 0
+		}
+		n, _ := w.Write(data)
+		return uint64(n)
+	}
+	file_align := func() {
+		write(make([]byte, align_padding(pos()-off.header, uint64(hdr.PageSize()))))
+	}
+
+	if boot.Flags[DHTB_FLAG] {
+		// Skip DHTB header
+		write(make([]byte, DHTB_HDR_SZ))
+	} else if boot.Flags[BLOB_FLAG] {
+		// Blob header and partition table
+		write(boot.Map[:len(boot.Map)-len(boot.HdrAddr)])
+	} else if boot.Flags[NOOKHD_FLAG] || boot.Flags[ACCLAIM_FLAG] {
+		// Loader pre-header
+		write(boot.Ignore)
+	}
+
+	// Reserve header space, the new header is copied in after all blocks
+	off.header = pos()
+	if boot.Flags[AMONET_FLAG] {
+		write(boot.Ignore)
+	}
+	write(make([]byte, hdr.HdrSpace()-(pos()-off.header)))
+
+	// kernel
+	off.kernel = pos()
+	if boot.Flags[MTK_KERNEL] {
+		// Copy MTK headers
+		binary.Write(w, binary.LittleEndian, boot.K_hdr)
+	}
+	if boot.Flags[ZIMAGE_KERNEL] {
+		// Copy zImage headers
+		write(boot.zimage()[:boot.ZInfo.HdrSz])
+	}
+	if exists(KERNEL_FILE) {
+		kernel, err := os.ReadFile(KERNEL_FILE)
+		if err != nil {
+			return err
+		}
+		if boot.Flags[ZIMAGE_KERNEL] {
+			piggy := new(bytes.Buffer)
+			if _, err := writeBlock(piggy, kernel, boot.K_fmt, skip_comp); err != nil {
+				return err
+			}
+			// Reserve the last 4 bytes for the uncompressed vmlinux size
+			piggy_sz := uint64(piggy.Len())
+			if !skip_comp {
+				piggy_sz += 4
+			}
+			if piggy_sz > uint64(len(boot.Kernel)) {
+				fmt.Fprintln(os.Stderr, "! Recompressed kernel is too large, using original kernel")
+				write(boot.Kernel)
+			} else {
+				// Pad zeros to make sure the zImage file size does not change
+				write(piggy.Bytes())
+				pad := make([]byte, len(boot.Kernel)-piggy.Len())
+				if !skip_comp {
+					binary.LittleEndian.PutUint32(pad[len(pad)-4:], uint32(len(kernel)))
+				}
+				write(pad)
+			}
+			hdr.SetKernelSize(uint32(len(boot.Kernel)))
+		} else {
+			size, err := writeBlock(w, kernel, boot.K_fmt, skip_comp)
+			if err != nil {
+				return err
+			}
+			hdr.SetKernelSize(uint32(size))
+		}
+	} else if len(boot.Kernel) != 0 {
+		hdr.SetKernelSize(uint32(write(boot.Kernel)))
+	}
+	if boot.Flags[ZIMAGE_KERNEL] {
+		// Copy zImage tail and adjust size accordingly
+		hdr.SetKernelSize(hdr.KernelSize() + boot.ZInfo.HdrSz + uint32(write(boot.ZInfo.Tail)))
+	}
+
+	// kernel dtb
+	if exists(KER_DTB_FILE) {
+		size, err := restore(w, KER_DTB_FILE)
+		if err != nil {
+			return err
+		}
+		hdr.SetKernelSize(hdr.KernelSize() + uint32(size))
+	}
+	file_align()
+
+	// ramdisk
+	off.ramdisk = pos()
+	var ramdisk_table []byte
+	if boot.Hdr.VendorRamdiskTableEntryNum() != 0 {
+		// v4 vendor boot image
+		orig := boot.VendorRamdiskEntries()
+		entries, err := loadVendorRamdiskTable(orig)
+		if err != nil {
+			return err
+		}
+		if len(entries) != int(hdr.VendorRamdiskTableEntryNum()) {
+			return errors.New("vendor ramdisk table entry number mismatch")
+		}
+
+		table := new(bytes.Buffer)
+		ramdisk_offset := uint32(0)
+		for i := range entries {
+			it := &entries[i]
+			file := filepath.Join(VND_RAMDISK_DIR, vendorRamdiskFile(it.RamdiskName[:]))
+
+			// Find out the original ramdisk with the same name
+			var orig_ramdisk []byte = nil
+			for _, o := range orig {
+				if o.RamdiskName == it.RamdiskName {
+					orig_ramdisk = boot.Ramdisk[o.RamdiskOffset : o.RamdiskOffset+o.RamdiskSize]
+					break
+				}
+			}
+			var f format_t = UNKNOWN
+			if orig_ramdisk != nil {
+				f = checkFmtLg(orig_ramdisk, uint64(len(orig_ramdisk)))
+			} else if len(orig) > 0 {
+				f = checkFmtLg(boot.Ramdisk[orig[0].RamdiskOffset:], uint64(orig[0].RamdiskSize))
+			}
+
+			it.RamdiskOffset = ramdisk_offset
+			if exists(file) {
+				size, err := restoreBlock(w, file, f, skip_comp)
+				if err != nil {
+					return err
+				}
+				it.RamdiskSize = uint32(size)
+			} else if orig_ramdisk != nil {
+				it.RamdiskSize = uint32(write(orig_ramdisk))
+			} else {
+				return fmt.Errorf("cannot find vendor ramdisk %s", file)
+			}
+			ramdisk_offset += it.RamdiskSize
+
+			binary.Write(table, binary.LittleEndian, it)
+			table.Write(make([]byte, int(hdr.VendorRamdiskTableEntrySize())-binary.Size(it)))
+		}
+		hdr.SetRamdiskSize(ramdisk_offset)
+		ramdisk_table = table.Bytes()
+		file_align()
+	} else if exists(RAMDISK_FILE) {
+		if boot.Flags[MTK_RAMDISK] {
+			// Copy MTK headers
+			binary.Write(w, binary.LittleEndian, boot.R_hdr)
+		}
+		r_fmt := boot.R_fmt
+		if !skip_comp && !hdr.IsVendor() && hdr.HeaderVersion() == 4 && r_fmt != LZ4_LEGACY {
+			// A v4 boot image ramdisk will have to be merged with other vendor ramdisks,
+			// and they have to use the exact same compression method. v4 GKIs are required to
+			// use lz4 (legacy), so hardcode the format here.
+			fmt.Fprintf(os.Stderr, "RAMDISK_FMT: [%s] -> [%s]\n", Fmt2Name(r_fmt), Fmt2Name(LZ4_LEGACY))
+			r_fmt = LZ4_LEGACY
+		}
+		size, err := restoreBlock(w, RAMDISK_FILE, r_fmt, skip_comp)
+		if err != nil {
+			return err
+		}
+		hdr.SetRamdiskSize(uint32(size))
+		file_align()
+	}
+
+	// second
+	off.second = pos()
+	if exists(SECOND_FILE) {
+		size, err := restore(w, SECOND_FILE)
+		if err != nil {
+			return err
+		}
+		hdr.SetSecondSize(uint32(size))
+		file_align()
+	}
+
+	// extra
+	off.extra = pos()
+	if exists(EXTRA_FILE) {
+		size, err := restoreBlock(w, EXTRA_FILE, boot.E_fmt, skip_comp)
+		if err != nil {
+			return err
+		}
+		hdr.SetExtraSize(uint32(size))
+		file_align()
+	}
+
+	// recovery_dtbo
+	if exists(RECV_DTBO_FILE) {
+		hdr.SetRecoveryDtboOffset(pos())
+		size, err := restore(w, RECV_DTBO_FILE)
+		if err != nil {
+			return err
+		}
+		hdr.SetRecoveryDtboSize(uint32(size))
+		file_align()
+	}
+
+	// dtb
+	off.dtb = pos()
+	if exists(DTB_FILE) {
+		size, err := restore(w, DTB_FILE)
+		if err != nil {
+			return err
+		}
+		hdr.SetDtbSize(uint32(size))
+		file_align()
+	}
+
+	// v4 boot signature
+	if len(boot.Signature) != 0 {
+		write(boot.Signature)
+		file_align()
+	}
+
+	// vendor ramdisk table
+	if len(ramdisk_table) != 0 {
+		write(ramdisk_table)
+		file_align()
+	}
+
+	// bootconfig
+	if exists(BOOTCONFIG_FILE) {
+		size, err := restore(w, BOOTCONFIG_FILE)
+		if err != nil {
+			return err
+		}
+		hdr.SetBootconfigSize(uint32(size))
+		file_align()
+	}
+
+	// Proprietary stuff
+	if boot.Flags[SEANDROID_FLAG] {
+		write([]byte(SEANDROID_MAGIC))
+		if boot.Flags[DHTB_FLAG] {
+			write([]byte{0xff, 0xff, 0xff, 0xff})
+		}
+	}
+	if boot.Flags[LG_BUMP_FLAG] {
+		write([]byte(LG_BUMP_MAGIC))
+	}
+
+	off.total = pos()
+	file_align()
+
+	// AVB 2.0 stuff
+	if boot.Flags[AVB_FLAG] {
+		// Align to 4096 for vbmeta
+		write(make([]byte, align_padding(pos()-off.header, 4096)))
+		off.vbmeta = pos()
+		write(boot.VbmetaData())
+
+		// The footer has to stay at the end of the original partition
+		if pos()+uint64(binary.Size(AvbFooter{})) > uint64(len(boot.Map)) {
+			return errors.New("image size exceeds the original partition size")
+		}
+	}
+
+	// Pad image to original size if not chromeos (as it requires post processing)
+	if current := pos(); current < uint64(len(boot.Map)) && !boot.Flags[CHROMEOS_FLAG] {
+		write(make([]byte, uint64(len(boot.Map))-current))
+	}
+
+	if w.err != nil {
+		return w.err
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+
+	/******************
+	 * Patch the image
+	 ******************/
+
+	out_fd, err := os.OpenFile(out_img, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer out_fd.Close()
+	out, err := mmap.Map(out_fd, mmap.RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer out.Unmap()
+
+	// MTK headers
+	if boot.Flags[MTK_KERNEL] {
+		// Size follows the magic
+		binary.LittleEndian.PutUint32(out[off.kernel+4:], hdr.KernelSize())
+		hdr.SetKernelSize(hdr.KernelSize() + MTK_HDR_SZ)
+	}
+	if boot.Flags[MTK_RAMDISK] {
+		binary.LittleEndian.PutUint32(out[off.ramdisk+4:], hdr.RamdiskSize())
+		hdr.SetRamdiskSize(hdr.RamdiskSize() + MTK_HDR_SZ)
+	}
+
+	// Make sure header size matches
+	hdr.SetHeaderSize(uint32(hdr.HdrSize()))
+
+	// Update checksum
+	if hdr.Id() != nil {
+		h := sha1.New()
+		if boot.Flags[SHA256_FLAG] {
+			h = sha256.New()
+		}
+		update := func(off uint64, size uint32) {
+			h.Write(out[off : off+uint64(size)])
+			binary.Write(h, binary.LittleEndian, size)
+		}
+		update(off.kernel, hdr.KernelSize())
+		update(off.ramdisk, hdr.RamdiskSize())
+		update(off.second, hdr.SecondSize())
+		if size := hdr.ExtraSize(); size != 0 {
+			update(off.extra, size)
+		}
+		ver := hdr.HeaderVersion()
+		if ver == 1 || ver == 2 {
+			update(hdr.RecoveryDtboOffset(), hdr.RecoveryDtboSize())
+		}
+		if ver == 2 {
+			update(off.dtb, hdr.DtbSize())
+		}
+		hdr.SetId(h.Sum(nil))
+	}
+
+	// Print new header info
+	hdr.Print()
+
+	// Copy main header
+	raw_hdr, err := hdr.RawHdr()
+	if err != nil {
+		return err
+	}
+	if boot.Flags[AMONET_FLAG] {
+		// Keep the microloader in front of the real header
+		real_hdr_sz := min(hdr.HdrSpace()-AMONET_MICROLOADER_SZ, hdr.HdrSize())
+		copy(out[off.header+AMONET_MICROLOADER_SZ:], raw_hdr[:real_hdr_sz])
+	} else {
+		copy(out[off.header:], raw_hdr)
+	}
+
+	if boot.Flags[DHTB_FLAG] {
+		// DHTB header
+		d_hdr := DhtbHdr{Size: uint32(off.total - DHTB_HDR_SZ)}
+		copy(d_hdr.Magic[:], DHTB_MAGIC)
+		sum := sha256.Sum256(out[DHTB_HDR_SZ:off.total])
+		copy(d_hdr.Checksum[:], sum[:])
+		buf := new(bytes.Buffer)
+		binary.Write(buf, binary.LittleEndian, &d_hdr)
+		copy(out, buf.Bytes())
+	}
+
+	if boot.Flags[BLOB_FLAG] {
+		// Blob header
+		entry, _, _ := findBlobLnx(out)
+		// BlobPart.Size and BlobHdr.Datalen
+		binary.LittleEndian.PutUint32(out[entry+8:], uint32(off.total-off.header))
+		binary.LittleEndian.PutUint32(out[20:], uint32(off.total-BLOB_SECURE_HDR_SZ))
+	}
+
+	if boot.Flags[AVB_FLAG] {
+		// Copy and patch AVB structures
+		footer := *boot.AvbFooter
+		footer.OriginalImageSize = off.total - off.header
+		footer.VbmetaOffset = off.vbmeta - off.header
+		buf := new(bytes.Buffer)
+		binary.Write(buf, binary.BigEndian, &footer)
+		copy(out[len(out)-buf.Len():], buf.Bytes())
+
+		if CheckEnv("PATCHVBMETAFLAG") {
+			vbmeta := *boot.Vbmeta
+			// AVB_VBMETA_IMAGE_FLAGS_HASHTREE_DISABLED | AVB_VBMETA_IMAGE_FLAGS_VERIFICATION_DISABLED
+			vbmeta.Flags = 3
+			buf.Reset()
+			binary.Write(buf, binary.BigEndian, &vbmeta)
+			copy(out[off.vbmeta:], buf.Bytes())
+		}
+
+		// Update hash descriptor over the new image
+		meta := out[off.vbmeta : off.vbmeta+footer.VbmetaSize]
+		if err := updateAvbHashDescriptor(meta, out[off.header:off.total]); err != nil {
+			return err
+		}
+	}
+
+	if err := out.Flush(); err != nil {
+		return err
+	}
+
+	if boot.Flags[AVB1_SIGNED_FLAG] {
+		sig, err := SignBootImage(out[off.header:off.total], "/boot", "", "")
+		if err != nil {
+			return fmt.Errorf("failed to sign boot image: %w", err)
+		}
+		if _, err := out_fd.WriteAt(sig, int64(off.total)); err != nil {
+			return err
+		}
+	}
+
+	if boot.Flags[CHROMEOS_FLAG] {
+		// Wrap the image into a vboot kernel partition signed with developer keys
+		img, err := SignChromeOS(bytes.Clone(out))
+		if err != nil {
+			return fmt.Errorf("failed to sign chromeos image: %w", err)
+		}
+		if _, err := out_fd.WriteAt(img, 0); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -1,9 +1,17 @@
 package magiskboot_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
+	"io"
 	"magiskboot"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -35,3 +43,1113 @@ func TestAlign(t *testing.T) {
 		}
 	}
 }
+
+func makeBootImg(t *testing.T, hdr any, page_size int, blocks ...[]byte) []byte {
+	buf := new(bytes.Buffer)
+	pad := func() {
+		buf.Write(make([]byte, (page_size-buf.Len()%page_size)%page_size))
+	}
+	if err := binary.Write(buf, binary.LittleEndian, hdr); err != nil {
+		t.Fatal(err)
+	}
+	pad()
+	for _, b := range blocks {
+		buf.Write(b)
+		pad()
+	}
+	return buf.Bytes()
+}
+
+func gzipData(t *testing.T, data []byte) []byte {
+	buf := new(bytes.Buffer)
+	w := gzip.NewWriter(buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+var (
+	testKernel  = bytes.Repeat([]byte("KERNEL"), 1000)
+	testRamdisk = []byte("070701 fake ramdisk")
+	testSecond  = []byte("SECOND")
+	testDtbo    = []byte("RECOVERY_DTBO")
+	testDtb     = []byte("DTB")
+)
+
+func makeBootImgV2(t *testing.T) []byte {
+	gz_kernel := gzipData(t, testKernel)
+	hdr := magiskboot.BootImgHdrV2{}
+	copy(hdr.Magic[:], magiskboot.BOOT_MAGIC)
+	hdr.KernelSize = uint32(len(gz_kernel))
+	hdr.RamdiskSize = uint32(len(testRamdisk))
+	hdr.SecondSize = uint32(len(testSecond))
+	hdr.PageSize = 2048
+	hdr.HeaderVersion = 2
+	hdr.RecoveryDtboSize = uint32(len(testDtbo))
+	hdr.HeaderSize = uint32(binary.Size(hdr))
+	hdr.DtbSize = uint32(len(testDtb))
+
+	return makeBootImg(t, &hdr, 2048, gz_kernel, testRamdisk, testSecond, testDtbo, testDtb)
+}
+
+func checkFiles(t *testing.T, files map[string][]byte) {
+	for f, expect := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, expect) {
+			t.Fatalf("Mismatch at: %v\nExcept: %v\nBut: %v", f, expect, data)
+		}
+	}
+}
+
+func unpack(t *testing.T, image string, skip_decomp, hdr bool) int {
+	ret, err := magiskboot.Unpack(image, skip_decomp, hdr)
+	if err != nil {
+		t.Fatalf("Unpack %v failed: %v", image, err)
+	}
+	return ret
+}
+
+func repack(t *testing.T, src_img, out_img string, skip_comp bool) {
+	if err := magiskboot.Repack(src_img, out_img, skip_comp); err != nil {
+		t.Fatalf("Repack %v failed: %v", src_img, err)
+	}
+}
+
+// Collect what f prints to stderr
+func captureStderr(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- data
+	}()
+	stderr := os.Stderr
+	os.Stderr = w
+	defer func() {
+		os.Stderr = stderr
+	}()
+	f()
+	w.Close()
+	return string(<-out)
+}
+
+func loadBootImg(t *testing.T, image string) *magiskboot.BootImg {
+	boot, err := magiskboot.NewBootImg(image)
+	if err != nil {
+		t.Fatalf("Load %v failed: %v", image, err)
+	}
+	return boot
+}
+
+func TestUnpackV2(t *testing.T) {
+	t.Log("Test unpack boot image header v2")
+	t.Chdir(t.TempDir())
+
+	if err := os.WriteFile("boot.img", makeBootImgV2(t), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if ret := unpack(t, "boot.img", false, false); ret != 0 {
+		t.Fatalf("Unpack failed, Except: 0, But: %v", ret)
+	}
+
+	checkFiles(t, map[string][]byte{
+		magiskboot.KERNEL_FILE:    testKernel,
+		magiskboot.RAMDISK_FILE:   testRamdisk,
+		magiskboot.SECOND_FILE:    testSecond,
+		magiskboot.RECV_DTBO_FILE: testDtbo,
+		magiskboot.DTB_FILE:       testDtb,
+	})
+}
+
+func TestRepackV2(t *testing.T) {
+	t.Log("Test repack boot image header v2")
+	t.Chdir(t.TempDir())
+
+	orig := makeBootImgV2(t)
+	if err := os.WriteFile("boot.img", orig, 0644); err != nil {
+		t.Fatal(err)
+	}
+	unpack(t, "boot.img", false, false)
+
+	// Repack without modification should give the same image except checksum
+	repack(t, "boot.img", "new-boot.img", false)
+	boot := loadBootImg(t, "new-boot.img")
+	if boot.Hdr.KernelSize() != uint32(len(gzipData(t, testKernel))) {
+		t.Fatalf("Kernel size mismatch, Except: %v, But: %v", len(gzipData(t, testKernel)), boot.Hdr.KernelSize())
+	}
+	boot.Close()
+
+	ramdisk := bytes.Repeat([]byte("070701 new ramdisk"), 200)
+	os.WriteFile(magiskboot.RAMDISK_FILE, ramdisk, 0644)
+	repack(t, "boot.img", "new-boot.img", false)
+
+	boot = loadBootImg(t, "new-boot.img")
+	defer boot.Close()
+	if ret := int(boot.Hdr.RamdiskSize()); ret != len(ramdisk) {
+		t.Fatalf("Ramdisk size mismatch, Except: %v, But: %v", len(ramdisk), ret)
+	}
+	if boot.Hdr.RecoveryDtboOffset() != 2048*5 {
+		t.Fatalf("Recovery dtbo offset mismatch, Except: %v, But: %v", 2048*5, boot.Hdr.RecoveryDtboOffset())
+	}
+	for name, expect := range map[string][]byte{
+		"kernel":  gzipData(t, testKernel),
+		"ramdisk": ramdisk,
+		"second":  testSecond,
+		"dtb":     testDtb,
+	} {
+		data := map[string][]byte{
+			"kernel":  boot.Kernel,
+			"ramdisk": boot.Ramdisk,
+			"second":  boot.Second,
+			"dtb":     boot.Dtb,
+		}[name]
+		if !bytes.Equal(data, expect) {
+			t.Fatalf("Mismatch at: %v\nExcept: %v\nBut: %v", name, expect, data)
+		}
+	}
+
+	h := sha1.New()
+	for _, blk := range [][]byte{boot.Kernel, boot.Ramdisk, boot.Second, boot.RecoveryDtbo, boot.Dtb} {
+		h.Write(blk)
+		binary.Write(h, binary.LittleEndian, uint32(len(blk)))
+	}
+	if id := boot.Hdr.Id(); !bytes.Equal(id[:sha1.Size], h.Sum(nil)) {
+		t.Fatalf("Checksum mismatch, Except: %x, But: %x", h.Sum(nil), id[:sha1.Size])
+	}
+}
+
+func TestUnpackV4InitBoot(t *testing.T) {
+	t.Log("Test unpack init_boot image header v4")
+	t.Chdir(t.TempDir())
+
+	ramdisk := []byte("070701 fake ramdisk")
+	signature := bytes.Repeat([]byte{0xaa}, 16)
+
+	hdr := magiskboot.BootImgHdrV4{}
+	copy(hdr.Magic[:], magiskboot.BOOT_MAGIC)
+	hdr.RamdiskSize = uint32(len(ramdisk))
+	hdr.HeaderSize = uint32(binary.Size(hdr))
+	hdr.HeaderVersion = 4
+	hdr.SignatureSize = uint32(len(signature))
+
+	img := makeBootImg(t, &hdr, 4096, ramdisk, signature)
+	if err := os.WriteFile("init_boot.img", img, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if ret := unpack(t, "init_boot.img", false, false); ret != 0 {
+		t.Fatalf("Unpack failed, Except: 0, But: %v", ret)
+	}
+
+	if _, err := os.Stat(magiskboot.KERNEL_FILE); !os.IsNotExist(err) {
+		t.Fatalf("Unexpected kernel file dumped from init_boot")
+	}
+	data, err := os.ReadFile(magiskboot.RAMDISK_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, ramdisk) {
+		t.Fatalf("Except: %v\nBut: %v", ramdisk, data)
+	}
+
+	boot := loadBootImg(t, "init_boot.img")
+	defer boot.Close()
+	if !bytes.Equal(boot.Signature, signature) {
+		t.Fatalf("Signature mismatch, Except: %v, But: %v", signature, boot.Signature)
+	}
+}
+
+func TestUnpackVendorV4(t *testing.T) {
+	t.Log("Test unpack vendor_boot image header v4")
+	t.Chdir(t.TempDir())
+
+	platform := []byte("070701 platform ramdisk")
+	dlkm := gzipData(t, []byte("070701 dlkm ramdisk"))
+	dtb := []byte("DTB")
+	bootconfig := []byte("androidboot.hardware=foo\n")
+
+	entries := []magiskboot.VendorRamdiskTableEntryV4{{}, {}}
+	entries[0].RamdiskSize = uint32(len(platform))
+	entries[0].RamdiskType = magiskboot.VENDOR_RAMDISK_TYPE_PLATFORM
+	entries[1].RamdiskSize = uint32(len(dlkm))
+	entries[1].RamdiskOffset = uint32(len(platform))
+	entries[1].RamdiskType = magiskboot.VENDOR_RAMDISK_TYPE_DLKM
+	copy(entries[1].RamdiskName[:], "dlkm")
+	entries[1].BoardId[0] = 0x1234
+	table := new(bytes.Buffer)
+	binary.Write(table, binary.LittleEndian, entries)
+
+	hdr := magiskboot.BootImgHdrVndV4{}
+	copy(hdr.Magic[:], magiskboot.VENDOR_BOOT_MAGIC)
+	hdr.HeaderVersion = 4
+	hdr.PageSize = 4096
+	hdr.RamdiskSize = uint32(len(platform) + len(dlkm))
+	hdr.HeaderSize = uint32(binary.Size(hdr))
+	hdr.DtbSize = uint32(len(dtb))
+	hdr.VendorRamdiskTableSize = uint32(table.Len())
+	hdr.VendorRamdiskTableEntryNum = 2
+	hdr.VendorRamdiskTableEntrySize = uint32(binary.Size(entries[0]))
+	hdr.BootconfigSize = uint32(len(bootconfig))
+
+	img := makeBootImg(t, &hdr, 4096, append(platform, dlkm...), dtb, table.Bytes(), bootconfig)
+	if err := os.WriteFile("vendor_boot.img", img, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if ret := unpack(t, "vendor_boot.img", false, false); ret != 0 {
+		t.Fatalf("Unpack failed, Except: 0, But: %v", ret)
+	}
+
+	checkFiles(t, map[string][]byte{
+		"vendor_ramdisk/ramdisk.cpio": platform,
+		"vendor_ramdisk/dlkm.cpio":    []byte("070701 dlkm ramdisk"),
+		magiskboot.DTB_FILE:           dtb,
+		magiskboot.BOOTCONFIG_FILE:    bootconfig,
+	})
+
+	data, err := os.ReadFile(magiskboot.VND_RAMDISK_TBL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(bytes.Split(data, []byte("\n"))[1], []byte("name=dlkm type=3 board_id=0x00001234,")) {
+		t.Fatalf("Unexpected vendor ramdisk table: %s", data)
+	}
+
+	// Grow the first ramdisk, the second one should be moved behind
+	platform = bytes.Repeat(platform, 300)
+	os.WriteFile("vendor_ramdisk/ramdisk.cpio", platform, 0644)
+	repack(t, "vendor_boot.img", "new-boot.img", false)
+
+	os.RemoveAll(magiskboot.VND_RAMDISK_DIR)
+	if ret := unpack(t, "new-boot.img", false, false); ret != 0 {
+		t.Fatalf("Unpack failed, Except: 0, But: %v", ret)
+	}
+	checkFiles(t, map[string][]byte{
+		"vendor_ramdisk/ramdisk.cpio": platform,
+		"vendor_ramdisk/dlkm.cpio":    []byte("070701 dlkm ramdisk"),
+		magiskboot.BOOTCONFIG_FILE:    bootconfig,
+	})
+
+	boot := loadBootImg(t, "new-boot.img")
+	defer boot.Close()
+	it := boot.VendorRamdiskEntries()[1]
+	if it.RamdiskOffset != uint32(len(platform)) || it.BoardId[0] != 0x1234 || it.RamdiskType != magiskboot.VENDOR_RAMDISK_TYPE_DLKM {
+		t.Fatalf("Unexpected vendor ramdisk entry: %+v", it)
+	}
+
+	// Entries are checked against the ramdisk and table even without ramdisk
+	for _, c := range []struct {
+		ramdisk_sz, entry_num, entry_sz uint32
+		err                             error
+	}{
+		{0, 2, hdr.VendorRamdiskTableEntrySize, magiskboot.ErrTruncated},
+		{0, 1, 100, magiskboot.ErrUnsupported},
+		{hdr.RamdiskSize, 2, 100, magiskboot.ErrUnsupported},
+		{hdr.RamdiskSize, 3, hdr.VendorRamdiskTableEntrySize, magiskboot.ErrTruncated},
+	} {
+		bad := hdr
+		bad.RamdiskSize = c.ramdisk_sz
+		bad.VendorRamdiskTableEntryNum = c.entry_num
+		bad.VendorRamdiskTableEntrySize = c.entry_sz
+		img := makeBootImg(t, &bad, 4096, make([]byte, c.ramdisk_sz), dtb, table.Bytes(), bootconfig)
+		if err := os.WriteFile("vendor_boot.img", img, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if ret, err := magiskboot.Unpack("vendor_boot.img", false, false); ret != 1 || !errors.Is(err, c.err) {
+			t.Fatalf("Unpack bad table %+v, Except: %v, But: %v", c, []any{1, c.err}, []any{ret, err})
+		}
+		// Repack used to pad entries to the parsed entry size
+		if err := magiskboot.Repack("vendor_boot.img", "new-boot.img", false); !errors.Is(err, c.err) {
+			t.Fatalf("Repack bad table %+v, Except: %v, But: %v", c, c.err, err)
+		}
+	}
+}
+
+func TestHdrFile(t *testing.T) {
+	t.Log("Test dump and load header file")
+	t.Chdir(t.TempDir())
+
+	hdr := magiskboot.BootImgHdrV0{}
+	copy(hdr.Magic[:], magiskboot.BOOT_MAGIC)
+	hdr.RamdiskSize = uint32(len(testRamdisk))
+	hdr.PageSize = 2048
+	// 11.0.0, 2021-05
+	hdr.OsVersion = (11<<14)<<11 | (21<<4 | 5)
+	copy(hdr.Name[:], "foo")
+	copy(hdr.Cmdline[:], "console=ttyMSM0")
+
+	if err := os.WriteFile("boot.img", makeBootImg(t, &hdr, 2048, testRamdisk), 0644); err != nil {
+		t.Fatal(err)
+	}
+	unpack(t, "boot.img", false, true)
+
+	checkFiles(t, map[string][]byte{
+		magiskboot.HEADER_FILE: []byte("name=foo\ncmdline=console=ttyMSM0\nos_version=11.0.0\nos_patch_level=2021-05\npage_size=2048\n"),
+	})
+
+	cmdline := strings.Repeat("a", 600)
+	os.WriteFile(magiskboot.HEADER_FILE, []byte("name=bar\ncmdline="+cmdline+"\nos_version=12.1.0\nos_patch_level=2022-10\n"), 0644)
+	repack(t, "boot.img", "new-boot.img", false)
+
+	boot := loadBootImg(t, "new-boot.img")
+	defer boot.Close()
+	if ret := boot.Hdr.OsVersion(); ret != (12<<14|1<<7)<<11|(22<<4|10) {
+		t.Fatalf("OS version mismatch, But: %x", ret)
+	}
+	if ret := string(bytes.TrimRight(boot.Hdr.Name(), "\x00")); ret != "bar" {
+		t.Fatalf("Name mismatch, Except: bar, But: %v", ret)
+	}
+	if ret := string(boot.Hdr.Cmdline()) + string(bytes.TrimRight(boot.Hdr.ExtraCmdline(), "\x00")); ret != cmdline {
+		t.Fatalf("Cmdline mismatch, Except: %v, But: %v", cmdline, ret)
+	}
+
+	// Header padding is zeroed, not copied from the original page
+	kernel := bytes.Repeat([]byte("K"), 3000)
+	hdr.KernelSize = uint32(len(kernel))
+	if err := os.WriteFile("boot.img", makeBootImg(t, &hdr, 2048, kernel, testRamdisk), 0644); err != nil {
+		t.Fatal(err)
+	}
+	unpack(t, "boot.img", false, false)
+	os.WriteFile(magiskboot.HEADER_FILE, []byte("page_size=4096\n"), 0644)
+	repack(t, "boot.img", "new-boot.img", false)
+	data, err := os.ReadFile("new-boot.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr_sz := binary.Size(hdr)
+	if !bytes.Equal(data[hdr_sz:4096], make([]byte, 4096-hdr_sz)) || !bytes.Equal(data[4096:4096+len(kernel)], kernel) {
+		t.Fatalf("Page size 4096 layout mismatch, But: %q", data[hdr_sz:4096+len(kernel)])
+	}
+
+	for _, prop := range []string{
+		"os_version=12.x", "os_version=128.0.0",
+		"os_patch_level=1999-12", "os_patch_level=2128-01", "os_patch_level=2022-13", "os_patch_level=2022",
+		"page_size=0", "page_size=1024", "page_size=3000",
+	} {
+		os.WriteFile(magiskboot.HEADER_FILE, []byte(prop+"\n"), 0644)
+		if err := magiskboot.Repack("boot.img", "new-boot.img", false); err == nil {
+			t.Fatalf("Repack with %v, Except: error, But: %v", prop, err)
+		}
+	}
+}
+
+// Append vbmeta and AVB footer to img, like avbtool add_hash_footer
+func makeAvbImage(t *testing.T, img []byte, vbmeta []byte, part_size int) []byte {
+	buf := bytes.NewBuffer(bytes.Clone(img))
+	buf.Write(make([]byte, (4096-buf.Len()%4096)%4096))
+	vbmeta_off := buf.Len()
+	buf.Write(vbmeta)
+
+	footer := magiskboot.AvbFooter{
+		VersionMajor:      1,
+		OriginalImageSize: uint64(len(img)),
+		VbmetaOffset:      uint64(vbmeta_off),
+		VbmetaSize:        uint64(len(vbmeta)),
+	}
+	copy(footer.Magic[:], magiskboot.AVB_FOOTER_MAGIC)
+	buf.Write(make([]byte, part_size-buf.Len()-binary.Size(footer)))
+	if err := binary.Write(buf, binary.BigEndian, &footer); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeVbmeta(t *testing.T, descriptors []byte) []byte {
+	hdr := magiskboot.AvbVBMetaImageHeader{
+		RequiredLibavbVersionMajor: 1,
+		DescriptorsSize:            uint64(len(descriptors)),
+		AuxiliaryDataBlockSize:     uint64(len(descriptors)+63) &^ 63,
+	}
+	copy(hdr.Magic[:], magiskboot.AVB_MAGIC)
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	buf.Write(descriptors)
+	buf.Write(make([]byte, int(hdr.AuxiliaryDataBlockSize)-len(descriptors)))
+	return buf.Bytes()
+}
+
+func TestAvbFooter(t *testing.T) {
+	t.Log("Test AVB footer and vbmeta flags")
+	t.Chdir(t.TempDir())
+	t.Setenv("PATCHVBMETAFLAG", "true")
+
+	part_size := 64 * 1024
+	img := makeAvbImage(t, makeBootImgV2(t), makeVbmeta(t, nil), part_size)
+	if err := os.WriteFile("boot.img", img, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	unpack(t, "boot.img", false, false)
+	repack(t, "boot.img", "new-boot.img", false)
+
+	boot := loadBootImg(t, "new-boot.img")
+	defer boot.Close()
+	if !boot.Flags[magiskboot.AVB_FLAG] {
+		t.Fatalf("AVB_FLAG, Except: %v, But: %v", true, false)
+	}
+	if len(boot.Map) != part_size {
+		t.Fatalf("Image size mismatch, Except: %v, But: %v", part_size, len(boot.Map))
+	}
+	if boot.AvbFooter.OriginalImageSize != uint64(len(boot.Payload)) {
+		t.Fatalf("Original image size mismatch, Except: %v, But: %v", len(boot.Payload), boot.AvbFooter.OriginalImageSize)
+	}
+	if boot.Vbmeta.Flags != 3 {
+		t.Fatalf("Vbmeta flags mismatch, Except: %v, But: %v", 3, boot.Vbmeta.Flags)
+	}
+}
+
+func TestAvbHashDescriptor(t *testing.T) {
+	t.Log("Test AVB hash descriptor update")
+	t.Chdir(t.TempDir())
+
+	name := []byte("boot")
+	salt := []byte{0xde, 0xad, 0xbe, 0xef}
+	d := magiskboot.AvbHashDescriptor{
+		ImageSize:        1,
+		PartitionNameLen: uint32(len(name)),
+		SaltLen:          uint32(len(salt)),
+		DigestLen:        sha256.Size,
+	}
+	d.Parent.Tag = magiskboot.AVB_DESCRIPTOR_TAG_HASH
+	copy(d.HashAlgorithm[:], "sha256")
+	desc_sz := binary.Size(d) + len(name) + len(salt) + sha256.Size
+	desc_sz = (desc_sz + 7) &^ 7
+	d.Parent.NumBytesFollowing = uint64(desc_sz - binary.Size(d.Parent))
+
+	desc := new(bytes.Buffer)
+	binary.Write(desc, binary.BigEndian, &d)
+	desc.Write(name)
+	desc.Write(salt)
+	desc.Write(make([]byte, desc_sz-desc.Len()))
+
+	part_size := 64 * 1024
+	img := makeAvbImage(t, makeBootImgV2(t), makeVbmeta(t, desc.Bytes()), part_size)
+	if err := os.WriteFile("boot.img", img, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	unpack(t, "boot.img", false, false)
+	os.WriteFile(magiskboot.SECOND_FILE, []byte("NEW SECOND"), 0644)
+	repack(t, "boot.img", "new-boot.img", false)
+
+	boot := loadBootImg(t, "new-boot.img")
+	defer boot.Close()
+	if len(boot.Map) != part_size {
+		t.Fatalf("Image size mismatch, Except: %v, But: %v", part_size, len(boot.Map))
+	}
+
+	meta := boot.VbmetaData()
+	off := binary.Size(magiskboot.AvbVBMetaImageHeader{})
+	var nd magiskboot.AvbHashDescriptor
+	binary.Read(bytes.NewReader(meta[off:]), binary.BigEndian, &nd)
+	if nd.ImageSize != uint64(len(boot.Payload)) {
+		t.Fatalf("Image size mismatch, Except: %v, But: %v", len(boot.Payload), nd.ImageSize)
+	}
+	h := sha256.New()
+	h.Write(salt)
+	h.Write(boot.Payload)
+	expect := h.Sum(nil)
+	digest_off := off + binary.Size(nd) + len(name) + len(salt)
+	if digest := meta[digest_off : digest_off+sha256.Size]; !bytes.Equal(digest, expect) {
+		t.Fatalf("Digest mismatch, Except: %x, But: %x", expect, digest)
+	}
+
+	// Descriptor runs past the descriptors block
+	corrupt := bytes.Clone(desc.Bytes())
+	binary.BigEndian.PutUint64(corrupt[8:], uint64(len(corrupt)))
+	img = makeAvbImage(t, makeBootImgV2(t), makeVbmeta(t, corrupt), part_size)
+	if err := os.WriteFile("boot.img", img, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := magiskboot.Repack("boot.img", "new-boot.img", false); !errors.Is(err, magiskboot.ErrTruncated) {
+		t.Fatalf("Repack corrupted vbmeta, Except: %v, But: %v", magiskboot.ErrTruncated, err)
+	}
+}
+
+func TestDynImgHdr(t *testing.T) {
+	t.Log("Test boot image header api")
+
+	raw := func(hdr any) []byte {
+		buf := new(bytes.Buffer)
+		binary.Write(buf, binary.LittleEndian, hdr)
+		return buf.Bytes()
+	}
+
+	v2 := magiskboot.BootImgHdrV2{}
+	copy(v2.Magic[:], magiskboot.BOOT_MAGIC)
+	v2.HeaderVersion = 2
+	v2.PageSize = 2048
+	v2.KernelSize = 100
+	v2.KernelAddr = 0x10008000
+	v2.DtbSize = 10
+	v2.DtbAddr = 0x101f00000
+	hdr, err := magiskboot.NewDynImgHdr(raw(&v2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := hdr.(*magiskboot.DynImgV2); !ok {
+		t.Fatalf("Header type mismatch, Except: %T, But: %T", &magiskboot.DynImgV2{}, hdr)
+	}
+	if hdr.KernelSize() != 100 || hdr.DtbSize() != 10 || hdr.HdrSize() != 1660 {
+		t.Fatalf("Header fields mismatch, Except: %v, But: %v", []any{100, 10, 1660},
+			[]any{hdr.KernelSize(), hdr.DtbSize(), hdr.HdrSize()})
+	}
+	// Fields not exist in v2 are ignored
+	hdr.SetBootconfigSize(1)
+	hdr.SetExtraSize(2)
+	if hdr.BootconfigSize() != 0 || hdr.ExtraSize() != 0 || hdr.DtbSize() != 10 {
+		t.Fatalf("Missing fields modified, Except: %v, But: %v", []any{0, 0, 10},
+			[]any{hdr.BootconfigSize(), hdr.ExtraSize(), hdr.DtbSize()})
+	}
+	if hdr.KernelAddr() != 0x10008000 || hdr.DtbAddr() != 0x101f00000 {
+		t.Fatalf("Header addresses mismatch, Except: %v, But: %v", []any{0x10008000, 0x101f00000},
+			[]any{hdr.KernelAddr(), hdr.DtbAddr()})
+	}
+	hdr.SetRecoveryDtboOffset(4096)
+	hdr.SetName("foo")
+	hdr.SetTagsAddr(0x10000100)
+	hdr.SetDtbAddr(0x11f00000)
+	if ret, err := hdr.RawHdr(); err != nil || !bytes.Equal(ret[1636:1644], []byte{0, 0x10, 0, 0, 0, 0, 0, 0}) ||
+		string(ret[48:52]) != "foo\x00" || binary.LittleEndian.Uint32(ret[32:]) != 0x10000100 ||
+		binary.LittleEndian.Uint64(ret[1652:]) != 0x11f00000 {
+		t.Fatalf("Raw header not updated, But: %v", ret[:64])
+	}
+
+	v4 := magiskboot.BootImgHdrV4{}
+	copy(v4.Magic[:], magiskboot.BOOT_MAGIC)
+	v4.HeaderVersion = 4
+	v4.SignatureSize = 16
+	if hdr, err = magiskboot.NewDynImgHdr(raw(&v4)); err != nil {
+		t.Fatal(err)
+	}
+	hdr.SetPageSize(2048)
+	hdr.SetKernelAddr(0x10008000)
+	if hdr.PageSize() != 4096 || hdr.SignatureSize() != 16 || hdr.Name() != nil || hdr.KernelAddr() != 0 {
+		t.Fatalf("Header fields mismatch, Except: %v, But: %v", []any{4096, 16, nil, 0},
+			[]any{hdr.PageSize(), hdr.SignatureSize(), hdr.Name(), hdr.KernelAddr()})
+	}
+
+	if _, err := magiskboot.NewDynImgHdr(raw(&v4)[:100]); !errors.Is(err, magiskboot.ErrTruncated) {
+		t.Fatalf("Truncated header, Except: %v, But: %v", magiskboot.ErrTruncated, err)
+	}
+	if _, err := magiskboot.NewDynImgHdr(make([]byte, 4096)); !errors.Is(err, magiskboot.ErrBadMagic) {
+		t.Fatalf("Invalid header, Except: %v, But: %v", magiskboot.ErrBadMagic, err)
+	}
+
+	pxa := magiskboot.BootImgHdrPxa{}
+	copy(pxa.Magic[:], magiskboot.BOOT_MAGIC)
+	pxa.KernelSize = 100
+	pxa.ExtraSize = 20
+	pxa.PageSize = 2048
+	pxa.TagsAddr = 0x10000100
+	copy(pxa.Name[:], "pxa1088")
+	phdr := new(magiskboot.DynImgPxa)
+	if err := phdr.Init(raw(&pxa)); err != nil {
+		t.Fatal(err)
+	}
+	if phdr.KernelSize() != 100 || phdr.ExtraSize() != 20 || phdr.PageSize() != 2048 || len(phdr.Name()) != 24 ||
+		phdr.TagsAddr() != 0x10000100 {
+		t.Fatalf("PXA header fields mismatch, Except: %v, But: %v", []any{100, 20, 2048, 24, 0x10000100},
+			[]any{phdr.KernelSize(), phdr.ExtraSize(), phdr.PageSize(), len(phdr.Name()), phdr.TagsAddr()})
+	}
+}
+
+func mtkWrap(t *testing.T, name string, data []byte) []byte {
+	hdr := magiskboot.MtkHdr{Magic: binary.LittleEndian.Uint32([]byte(magiskboot.MTK_MAGIC)), Size: uint32(len(data))}
+	copy(hdr.Name[:], name)
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+func TestMtk(t *testing.T) {
+	t.Log("Test MTK kernel and ramdisk headers")
+	t.Chdir(t.TempDir())
+
+	kernel := mtkWrap(t, "KERNEL", gzipData(t, testKernel))
+	ramdisk := mtkWrap(t, "ROOTFS", testRamdisk)
+	hdr := magiskboot.BootImgHdrV0{}
+	copy(hdr.Magic[:], magiskboot.BOOT_MAGIC)
+	hdr.KernelSize = uint32(len(kernel))
+	hdr.RamdiskSize = uint32(len(ramdisk))
+	hdr.PageSize = 2048
+	if err := os.WriteFile("boot.img", makeBootImg(t, &hdr, 2048, kernel, ramdisk), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	unpack(t, "boot.img", false, false)
+	checkFiles(t, map[string][]byte{
+		magiskboot.KERNEL_FILE:  testKernel,
+		magiskboot.RAMDISK_FILE: testRamdisk,
+	})
+
+	ramdisk = []byte("070701 patched ramdisk")
+	os.WriteFile(magiskboot.RAMDISK_FILE, ramdisk, 0644)
+	repack(t, "boot.img", "new-boot.img", false)
+
+	boot := loadBootImg(t, "new-boot.img")
+	defer boot.Close()
+	if !boot.Flags[magiskboot.MTK_KERNEL] || !boot.Flags[magiskboot.MTK_RAMDISK] {
+		t.Fatalf("MTK flags, Except: %v, But: %v", []bool{true, true},
+			[]bool{boot.Flags[magiskboot.MTK_KERNEL], boot.Flags[magiskboot.MTK_RAMDISK]})
+	}
+	if boot.R_hdr.Size != uint32(len(ramdisk)) || strings.TrimRight(string(boot.R_hdr.Name[:]), "\x00") != "ROOTFS" {
+		t.Fatalf("MTK ramdisk header, Except: %v, But: %v", []any{len(ramdisk), "ROOTFS"},
+			[]any{boot.R_hdr.Size, strings.TrimRight(string(boot.R_hdr.Name[:]), "\x00")})
+	}
+	if boot.K_hdr.Size != uint32(len(boot.Kernel)) || strings.TrimRight(string(boot.K_hdr.Name[:]), "\x00") != "KERNEL" {
+		t.Fatalf("MTK kernel header, Except: %v, But: %v", []any{len(boot.Kernel), "KERNEL"},
+			[]any{boot.K_hdr.Size, strings.TrimRight(string(boot.K_hdr.Name[:]), "\x00")})
+	}
+	if !bytes.Equal(boot.Ramdisk, ramdisk) {
+		t.Fatalf("Ramdisk mismatch, Except: %q, But: %q", ramdisk, boot.Ramdisk)
+	}
+}
+
+func TestDhtb(t *testing.T) {
+	t.Log("Test DHTB header")
+	t.Chdir(t.TempDir())
+
+	tail := append([]byte(magiskboot.SEANDROID_MAGIC), 0xff, 0xff, 0xff, 0xff)
+	img := append(makeBootImgV2(t), tail...)
+	hdr := magiskboot.DhtbHdr{Size: uint32(len(img))}
+	copy(hdr.Magic[:], magiskboot.DHTB_MAGIC)
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, &hdr)
+	buf.Write(img)
+	if err := os.WriteFile("boot.img", buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	unpack(t, "boot.img", false, false)
+	checkFiles(t, map[string][]byte{
+		magiskboot.KERNEL_FILE:  testKernel,
+		magiskboot.RAMDISK_FILE: testRamdisk,
+	})
+
+	os.WriteFile(magiskboot.SECOND_FILE, []byte("NEW SECOND"), 0644)
+	repack(t, "boot.img", "new-boot.img", false)
+
+	boot := loadBootImg(t, "new-boot.img")
+	defer boot.Close()
+	if !boot.Flags[magiskboot.DHTB_FLAG] {
+		t.Fatalf("DHTB_FLAG, Except: %v, But: %v", true, false)
+	}
+	var d magiskboot.DhtbHdr
+	binary.Read(bytes.NewReader(boot.Map), binary.LittleEndian, &d)
+	if size := uint32(len(boot.Payload) + len(tail)); d.Size != size {
+		t.Fatalf("DHTB size mismatch, Except: %v, But: %v", size, d.Size)
+	}
+	if !bytes.HasPrefix(boot.Tail, tail) {
+		t.Fatalf("Tail mismatch, Except: %q, But: %q", tail, boot.Tail[:len(tail)])
+	}
+	sum := sha256.Sum256(boot.Map[512 : 512+d.Size])
+	if !bytes.Equal(d.Checksum[:sha256.Size], sum[:]) {
+		t.Fatalf("DHTB checksum mismatch, Except: %x, But: %x", sum, d.Checksum[:sha256.Size])
+	}
+}
+
+func TestTegraBlob(t *testing.T) {
+	t.Log("Test tegra signed blob")
+	t.Chdir(t.TempDir())
+
+	img := makeBootImgV2(t)
+	hdr := magiskboot.BlobHdr{
+		HdrVersion: 0x10000,
+		HdrSize:    60,
+		PartOffset: 60,
+		NumParts:   1,
+		Offset:     76,
+		Size:       uint32(len(img)),
+		Version:    1,
+	}
+	copy(hdr.SecureMagic[:], magiskboot.TEGRABLOB_MAGIC)
+	copy(hdr.Magic[:], "MSM-RADIO-UPDATE")
+	copy(hdr.Name[:], "LNX")
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, &hdr)
+	hdr.Datalen = uint32(buf.Len() + len(img) - magiskboot.BLOB_SECURE_HDR_SZ)
+	buf.Reset()
+	binary.Write(buf, binary.LittleEndian, &hdr)
+	buf.Write(img)
+	if err := os.WriteFile("blob.img", buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	unpack(t, "blob.img", false, false)
+	checkFiles(t, map[string][]byte{
+		magiskboot.KERNEL_FILE:  testKernel,
+		magiskboot.RAMDISK_FILE: testRamdisk,
+	})
+
+	os.WriteFile(magiskboot.SECOND_FILE, bytes.Repeat([]byte("SECOND"), 1000), 0644)
+	repack(t, "blob.img", "new-blob.img", false)
+
+	boot := loadBootImg(t, "new-blob.img")
+	defer boot.Close()
+	if !boot.Flags[magiskboot.BLOB_FLAG] {
+		t.Fatalf("BLOB_FLAG, Except: %v, But: %v", true, false)
+	}
+	var nhdr magiskboot.BlobHdr
+	binary.Read(bytes.NewReader(boot.Map), binary.LittleEndian, &nhdr)
+	if nhdr.Size != uint32(len(boot.Payload)) {
+		t.Fatalf("LNX size mismatch, Except: %v, But: %v", len(boot.Payload), nhdr.Size)
+	}
+	if datalen := uint32(len(boot.Map) - magiskboot.BLOB_SECURE_HDR_SZ); nhdr.Datalen != datalen {
+		t.Fatalf("Blob datalen mismatch, Except: %v, But: %v", datalen, nhdr.Datalen)
+	}
+}
+
+func TestTail(t *testing.T) {
+	t.Log("Test SEANDROIDENFORCE and LG bump tails")
+	t.Chdir(t.TempDir())
+
+	tests := map[string]int{
+		magiskboot.SEANDROID_MAGIC: int(magiskboot.SEANDROID_FLAG),
+		magiskboot.LG_BUMP_MAGIC:   int(magiskboot.LG_BUMP_FLAG),
+	}
+	for magic, flag := range tests {
+		img := append(makeBootImgV2(t), magic...)
+		if err := os.WriteFile("boot.img", img, 0644); err != nil {
+			t.Fatal(err)
+		}
+		unpack(t, "boot.img", false, false)
+		os.WriteFile(magiskboot.SECOND_FILE, bytes.Repeat([]byte("SECOND"), 1000), 0644)
+		repack(t, "boot.img", "new-boot.img", false)
+
+		boot := loadBootImg(t, "new-boot.img")
+		if !boot.Flags[flag] {
+			t.Fatalf("Tail flag %v, Except: %v, But: %v", flag, true, false)
+		}
+		if !bytes.HasPrefix(boot.Tail, []byte(magic)) {
+			t.Fatalf("Tail mismatch, Except: %q, But: %q", magic, boot.Tail[:min(len(boot.Tail), len(magic))])
+		}
+		boot.Close()
+	}
+}
+
+func TestPreHeader(t *testing.T) {
+	t.Log("Test NookHD/Acclaim loader and Amonet microloader")
+	t.Chdir(t.TempDir())
+
+	new_ramdisk := bytes.Repeat([]byte("070701 new ramdisk"), 200)
+	check := func(flag int, pre_sz int) {
+		orig, err := os.ReadFile("boot.img")
+		if err != nil {
+			t.Fatal(err)
+		}
+		unpack(t, "boot.img", false, false)
+		checkFiles(t, map[string][]byte{
+			magiskboot.KERNEL_FILE:  testKernel,
+			magiskboot.RAMDISK_FILE: testRamdisk,
+		})
+		os.WriteFile(magiskboot.RAMDISK_FILE, new_ramdisk, 0644)
+		repack(t, "boot.img", "new-boot.img", false)
+
+		boot := loadBootImg(t, "new-boot.img")
+		defer boot.Close()
+		if !boot.Flags[flag] {
+			t.Fatalf("Pre-header flag %v, Except: %v, But: %v", flag, true, false)
+		}
+		if !bytes.Equal(boot.Map[:pre_sz], orig[:pre_sz]) {
+			t.Fatalf("Pre-header mismatch, Except: %q, But: %q", orig[:64], boot.Map[:64])
+		}
+		if !bytes.Equal(boot.Ignore, orig[:pre_sz]) {
+			t.Fatalf("Ignore size mismatch, Except: %v, But: %v", pre_sz, len(boot.Ignore))
+		}
+		if !bytes.Equal(boot.Ramdisk, new_ramdisk) {
+			t.Fatalf("Ramdisk mismatch, Except: %v, But: %v", len(new_ramdisk), len(boot.Ramdisk))
+		}
+	}
+
+	// Acclaim: the whole boot image follows the loader
+	loader := magiskboot.BootImgHdrV0{}
+	copy(loader.Magic[:], magiskboot.BOOT_MAGIC)
+	copy(loader.Name[:], magiskboot.ACCLAIM_MAGIC)
+	loader.PageSize = 2048
+	img := makeBootImg(t, &loader, magiskboot.ACCLAIM_PRE_HEADER_SZ, []byte("LOADER"))
+	img = append(img[:magiskboot.ACCLAIM_PRE_HEADER_SZ], makeBootImgV2(t)...)
+	if err := os.WriteFile("boot.img", img, 0644); err != nil {
+		t.Fatal(err)
+	}
+	check(int(magiskboot.ACCLAIM_FLAG), magiskboot.ACCLAIM_PRE_HEADER_SZ)
+
+	// Amonet: only the header is shifted behind the microloader
+	gz_kernel := gzipData(t, testKernel)
+	hdr := magiskboot.BootImgHdrV0{}
+	copy(hdr.Magic[:], magiskboot.BOOT_MAGIC)
+	hdr.KernelSize = uint32(len(gz_kernel))
+	hdr.RamdiskSize = uint32(len(testRamdisk))
+	hdr.PageSize = 2048
+	copy(hdr.ExtraCmdline[:], strings.Repeat("x", len(hdr.ExtraCmdline)))
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, &hdr)
+	page := make([]byte, 2048)
+	copy(page, magiskboot.BOOT_MAGIC)
+	copy(page[64:], magiskboot.AMONET_MICROLOADER_MAGIC)
+	copy(page[magiskboot.AMONET_MICROLOADER_SZ:], buf.Bytes())
+	if err := os.WriteFile("boot.img", makeBootImg(t, page, 2048, gz_kernel, testRamdisk), 0644); err != nil {
+		t.Fatal(err)
+	}
+	check(int(magiskboot.AMONET_FLAG), magiskboot.AMONET_MICROLOADER_SZ)
+
+	// The extra cmdline at 608 of the v0 header overlaps the kernel past the page boundary
+	out := captureStderr(t, func() {
+		repack(t, "boot.img", "new-boot.img", false)
+	})
+	cmdline := "[" + strings.Repeat("x", 2048-magiskboot.AMONET_MICROLOADER_SZ-608) + "]"
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "CMDLINE") && !strings.HasSuffix(line, cmdline) {
+			t.Fatalf("Amonet cmdline, Except: %v, But: %q", cmdline, line)
+		}
+	}
+}
+
+const testZimageHdrSz = 256
+
+func makeZimage(t *testing.T, piggy []byte) []byte {
+	// zImage header, a bit of decompressor code, piggy, then GOT with piggy end offset
+	code := make([]byte, testZimageHdrSz-binary.Size(magiskboot.ZimageHdr{}))
+	// Short magics that could show up by chance in the decompressor code
+	copy(code[16:], "BZh\x00\x1f\x9e\x00\x5d\x00\x00\x00\xd0\x0d\xfe\xed\x00\x1f\x8b")
+	copy(code[64:], "\xfd7zXZ\x00\x00\x02\x21\x4c\x18\xff\xff\x89LZO")
+	piggy_end := uint32(testZimageHdrSz + len(piggy))
+	got := make([]uint32, 16)
+	got[15] = piggy_end
+	hdr := magiskboot.ZimageHdr{
+		Magic: binary.LittleEndian.Uint32([]byte(magiskboot.ZIMAGE_MAGIC)),
+		Start: 0,
+		End:   piggy_end + uint32(binary.Size(got)),
+	}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, &hdr)
+	buf.Write(code)
+	buf.Write(piggy)
+	binary.Write(buf, binary.LittleEndian, got)
+	return buf.Bytes()
+}
+
+func TestZimage(t *testing.T) {
+	t.Log("Test ARM zImage piggy")
+	t.Chdir(t.TempDir())
+
+	piggy := gzipData(t, testKernel)
+	zimage := makeZimage(t, piggy)
+	hdr := magiskboot.BootImgHdrV0{}
+	copy(hdr.Magic[:], magiskboot.BOOT_MAGIC)
+	hdr.KernelSize = uint32(len(zimage))
+	hdr.RamdiskSize = uint32(len(testRamdisk))
+	hdr.PageSize = 2048
+	if err := os.WriteFile("boot.img", makeBootImg(t, &hdr, 2048, zimage, testRamdisk), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	unpack(t, "boot.img", false, false)
+	checkFiles(t, map[string][]byte{
+		magiskboot.KERNEL_FILE: testKernel,
+	})
+
+	new_kernel := bytes.Repeat([]byte("KERNEL"), 500)
+	os.WriteFile(magiskboot.KERNEL_FILE, new_kernel, 0644)
+	repack(t, "boot.img", "new-boot.img", false)
+
+	boot := loadBootImg(t, "new-boot.img")
+	defer boot.Close()
+	if !boot.Flags[magiskboot.ZIMAGE_KERNEL] {
+		t.Fatalf("ZIMAGE_KERNEL, Except: %v, But: %v", true, false)
+	}
+	if boot.ZInfo.HdrSz != testZimageHdrSz {
+		t.Fatalf("zImage header size, Except: %v, But: %v", testZimageHdrSz, boot.ZInfo.HdrSz)
+	}
+	if len(boot.Kernel) != len(piggy) {
+		t.Fatalf("Piggy size, Except: %v, But: %v", len(piggy), len(boot.Kernel))
+	}
+	if !bytes.Equal(boot.ZInfo.Tail, zimage[testZimageHdrSz+len(piggy):]) {
+		t.Fatalf("zImage tail mismatch, Except: %v, But: %v", zimage[testZimageHdrSz+len(piggy):], boot.ZInfo.Tail)
+	}
+	if size := binary.LittleEndian.Uint32(boot.Kernel[len(boot.Kernel)-4:]); size != uint32(len(new_kernel)) {
+		t.Fatalf("vmlinux size, Except: %v, But: %v", len(new_kernel), size)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(boot.Kernel))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Multistream(false)
+	if data, _ := io.ReadAll(r); !bytes.Equal(data, new_kernel) {
+		t.Fatalf("Kernel mismatch, Except: %v, But: %v", len(new_kernel), len(data))
+	}
+	if boot.Z_hdr.End != uint32(len(zimage)) {
+		t.Fatalf("zImage end, Except: %v, But: %v", len(zimage), boot.Z_hdr.End)
+	}
+
+	// Piggy of other formats are found past the decoy magics
+	for _, name := range []string{"xz", "lzma", "lz4_legacy"} {
+		f := magiskboot.Name2Fmt(name)
+		buf := new(bytes.Buffer)
+		enc, err := magiskboot.NewEncoder(f, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc.Write(testKernel)
+		enc.Close()
+		zimage := makeZimage(t, buf.Bytes())
+		hdr.KernelSize = uint32(len(zimage))
+		if err := os.WriteFile("boot.img", makeBootImg(t, &hdr, 2048, zimage, testRamdisk), 0644); err != nil {
+			t.Fatal(err)
+		}
+		unpack(t, "boot.img", false, false)
+		checkFiles(t, map[string][]byte{
+			magiskboot.KERNEL_FILE: testKernel,
+		})
+		boot := loadBootImg(t, "boot.img")
+		if boot.ZInfo.HdrSz != testZimageHdrSz || boot.K_fmt != f {
+			t.Fatalf("zImage %s piggy, Except: %v, But: %v", name, []any{testZimageHdrSz, f}, []any{boot.ZInfo.HdrSz, boot.K_fmt})
+		}
+		boot.Close()
+	}
+
+	// Shorter than the zImage header, kept as raw kernel
+	short := makeZimage(t, nil)[:0x2c]
+	hdr.KernelSize = uint32(len(short))
+	if err := os.WriteFile("boot.img", makeBootImg(t, &hdr, 2048, short, testRamdisk), 0644); err != nil {
+		t.Fatal(err)
+	}
+	unpack(t, "boot.img", false, false)
+	checkFiles(t, map[string][]byte{
+		magiskboot.KERNEL_FILE: short,
+	})
+}
+
+func TestPxa(t *testing.T) {
+	t.Log("Test PXA boot image")
+	t.Chdir(t.TempDir())
+
+	name := "pxa1908-lte-boot-image"
+	extra := []byte("PXA EXTRA")
+	gz_kernel := gzipData(t, testKernel)
+	hdr := magiskboot.BootImgHdrPxa{}
+	copy(hdr.Magic[:], magiskboot.BOOT_MAGIC)
+	hdr.KernelSize = uint32(len(gz_kernel))
+	hdr.RamdiskSize = uint32(len(testRamdisk))
+	hdr.ExtraSize = uint32(len(extra))
+	hdr.Unknown = 0x10000000
+	hdr.TagsAddr = 0x10000100
+	hdr.PageSize = 2048
+	copy(hdr.Name[:], name)
+	if err := os.WriteFile("boot.img", makeBootImg(t, &hdr, 2048, gz_kernel, testRamdisk, extra), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	unpack(t, "boot.img", false, true)
+	checkFiles(t, map[string][]byte{
+		magiskboot.KERNEL_FILE:  testKernel,
+		magiskboot.RAMDISK_FILE: testRamdisk,
+		magiskboot.EXTRA_FILE:   extra,
+	})
+
+	new_ramdisk := bytes.Repeat([]byte("070701 new ramdisk"), 200)
+	os.WriteFile(magiskboot.RAMDISK_FILE, new_ramdisk, 0644)
+	repack(t, "boot.img", "new-boot.img", false)
+
+	boot := loadBootImg(t, "new-boot.img")
+	defer boot.Close()
+	if _, ok := boot.Hdr.(*magiskboot.DynImgPxa); !ok {
+		t.Fatalf("Header type mismatch, Except: %T, But: %T", &magiskboot.DynImgPxa{}, boot.Hdr)
+	}
+	if ret := strings.TrimRight(string(boot.Hdr.Name()), "\x00"); ret != name {
+		t.Fatalf("Name mismatch, Except: %v, But: %v", name, ret)
+	}
+	if !bytes.Equal(boot.Ramdisk, new_ramdisk) || !bytes.Equal(boot.Extra, extra) {
+		t.Fatalf("Blocks mismatch, Except: %v, But: %v", []int{len(new_ramdisk), len(extra)},
+			[]int{len(boot.Ramdisk), len(boot.Extra)})
+	}
+}
+
+func TestBadImage(t *testing.T) {
+	t.Log("Test typed errors of invalid boot images")
+	t.Chdir(t.TempDir())
+
+	if err := os.WriteFile("boot.img", bytes.Repeat([]byte("garbage!"), 1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := magiskboot.NewBootImg("boot.img"); !errors.Is(err, magiskboot.ErrBadMagic) {
+		t.Fatalf("Load garbage, Except: %v, But: %v", magiskboot.ErrBadMagic, err)
+	}
+	if ret, err := magiskboot.Unpack("boot.img", false, false); ret != 1 || !errors.Is(err, magiskboot.ErrBadMagic) {
+		t.Fatalf("Unpack garbage, Except: %v, But: %v", []any{1, magiskboot.ErrBadMagic}, []any{ret, err})
+	}
+	if err := magiskboot.Compress("zopfli", "boot.img", "boot.img.gz"); !errors.Is(err, magiskboot.ErrUnsupported) {
+		t.Fatalf("Compress zopfli, Except: %v, But: %v", magiskboot.ErrUnsupported, err)
+	}
+	if err := magiskboot.Decompress("boot.img", "-"); !errors.Is(err, magiskboot.ErrBadMagic) {
+		t.Fatalf("Decompress garbage, Except: %v, But: %v", magiskboot.ErrBadMagic, err)
+	}
+	if _, err := magiskboot.Unxz([]byte("garbage!")); !errors.Is(err, magiskboot.ErrBadMagic) {
+		t.Fatalf("Unxz garbage, Except: %v, But: %v", magiskboot.ErrBadMagic, err)
+	}
+	if xz, err := magiskboot.Xz(testKernel); err != nil {
+		t.Fatalf("Xz failed, Except: %v, But: %v", nil, err)
+	} else if data, err := magiskboot.Unxz(xz); !bytes.Equal(data, testKernel) || err != nil {
+		t.Fatalf("Unxz mismatch, Except: %v, But: %v", testKernel, []any{data, err})
+	}
+
+	// Header runs past the end of file
+	if err := os.WriteFile("boot.img", []byte(magiskboot.BOOT_MAGIC+strings.Repeat("\x00", 100)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := magiskboot.NewBootImg("boot.img"); !errors.Is(err, magiskboot.ErrTruncated) {
+		t.Fatalf("Load truncated header, Except: %v, But: %v", magiskboot.ErrTruncated, err)
+	}
+
+	// Blocks run past the end of file
+	img := makeBootImgV2(t)
+	if err := os.WriteFile("boot.img", img[:len(img)-2048], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := magiskboot.NewBootImg("boot.img"); !errors.Is(err, magiskboot.ErrTruncated) {
+		t.Fatalf("Load truncated, Except: %v, But: %v", magiskboot.ErrTruncated, err)
+	}
+
+	// Trailing data after a complete stream is ignored, a cut stream is not
+	gz_kernel := gzipData(t, testKernel)
+	xz_kernel, err := magiskboot.Xz(testKernel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		kernel []byte
+		err    error
+	}{
+		{append(bytes.Clone(gz_kernel), "TRAILING"...), nil},
+		{gz_kernel[:len(gz_kernel)/2], magiskboot.ErrTruncated},
+		{append(bytes.Clone(xz_kernel), "TRAILING"...), nil},
+		{xz_kernel[:len(xz_kernel)-1], magiskboot.ErrTruncated},
+		{xz_kernel[:len(xz_kernel)/2], magiskboot.ErrTruncated},
+	} {
+		hdr := magiskboot.BootImgHdrV0{}
+		copy(hdr.Magic[:], magiskboot.BOOT_MAGIC)
+		hdr.KernelSize = uint32(len(c.kernel))
+		hdr.PageSize = 2048
+		if err := os.WriteFile("boot.img", makeBootImg(t, &hdr, 2048, c.kernel), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := magiskboot.Unpack("boot.img", false, false); !errors.Is(err, c.err) {
+			t.Fatalf("Unpack kernel, Except: %v, But: %v", c.err, err)
+		}
+		if c.err == nil {
+			checkFiles(t, map[string][]byte{magiskboot.KERNEL_FILE: testKernel})
+		}
+	}
+}
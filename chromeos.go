@@ -0,0 +1,193 @@
+package magiskboot
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	_ "embed"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// vboot developer keys used to sign ChromeOS kernel partitions
+var (
+	//go:embed keys/kernel.keyblock
+	chromeosKeyblock []byte
+	//go:embed keys/kernel_data_key.vbprivk
+	chromeosDataKey []byte
+)
+
+const (
+	// Size of keyblock + kernel preamble
+	CHROMEOS_HDR_SZ = 0x10000
+	// Layout of the kernel blob
+	CROS_ALIGN            = 4096
+	CROS_CONFIG_SIZE      = 4096
+	CROS_PARAMS_SIZE      = 4096
+	CROS_32BIT_ENTRY_ADDR = 0x100000
+
+	VB2_KERNEL_PREAMBLE_HEADER_VERSION_MAJOR = 2
+	VB2_KERNEL_PREAMBLE_HEADER_VERSION_MINOR = 2
+)
+
+// Offsets in vboot structures are relative to the structure itself
+type Vb2Signature struct {
+	SigOffset uint32
+	Reserved0 uint32
+	SigSize   uint32
+	Reserved1 uint32
+	DataSize  uint32
+	Reserved2 uint32
+}
+
+type Vb2PackedKey struct {
+	KeyOffset  uint32
+	Reserved0  uint32
+	KeySize    uint32
+	Reserved1  uint32
+	Algorithm  uint32
+	Reserved2  uint32
+	KeyVersion uint32
+	Reserved3  uint32
+}
+
+type Vb2Keyblock struct {
+	Magic              [8]byte
+	HeaderVersionMajor uint32
+	HeaderVersionMinor uint32
+	KeyblockSize       uint32
+	Reserved0          uint32
+	KeyblockSignature  Vb2Signature
+	KeyblockHash       Vb2Signature
+	KeyblockFlags      uint32
+	Reserved1          uint32
+	DataKey            Vb2PackedKey
+}
+
+type Vb2KernelPreamble struct {
+	PreambleSize         uint32
+	Reserved0            uint32
+	PreambleSignature    Vb2Signature
+	HeaderVersionMajor   uint32
+	HeaderVersionMinor   uint32
+	KernelVersion        uint32
+	Reserved1            uint32
+	BodyLoadAddress      uint64
+	BootloaderAddress    uint64
+	BootloaderSize       uint32
+	Reserved2            uint32
+	BodySignature        Vb2Signature
+	VmlinuzHeaderAddress uint64
+	VmlinuzHeaderSize    uint32
+	Reserved3            uint32
+	Flags                uint32
+}
+
+// vboot crypto algorithm: RSA1024/2048/4096/8192 x SHA1/SHA256/SHA512
+func vb2Hash(alg uint64) crypto.Hash {
+	switch alg % 3 {
+	case 0:
+		return crypto.SHA1
+	case 1:
+		return crypto.SHA256
+	default:
+		return crypto.SHA512
+	}
+}
+
+// Parse vbprivk: algorithm as uint64 followed by PKCS#1 DER private key
+func parseVbPrivKey(data []byte) (*rsa.PrivateKey, uint64, error) {
+	if len(data) < 8 {
+		return nil, 0, errors.New("invalid vboot private key")
+	}
+	alg := binary.LittleEndian.Uint64(data)
+	if alg > 11 {
+		return nil, 0, fmt.Errorf("unsupported vboot algorithm %d", alg)
+	}
+	key, err := x509.ParsePKCS1PrivateKey(data[8:])
+	if err != nil {
+		return nil, 0, err
+	}
+	return key, alg, nil
+}
+
+func vb2Sign(data []byte, key *rsa.PrivateKey, alg uint64) ([]byte, error) {
+	h := vb2Hash(alg)
+	hash := h.New()
+	hash.Write(data)
+	return rsa.SignPKCS1v15(nil, key, h, hash.Sum(nil))
+}
+
+// Wrap the boot image into a signed ChromeOS kernel partition,
+// the same as `futility vbutil_kernel --pack --arch arm --version 1 --flags 0x1`
+// with empty config and bootloader
+func SignChromeOS(image []byte) ([]byte, error) {
+	key, alg, err := parseVbPrivKey(chromeosDataKey)
+	if err != nil {
+		return nil, err
+	}
+	var kb Vb2Keyblock
+	if err := binary.Read(bytes.NewReader(chromeosKeyblock), binary.LittleEndian, &kb); err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(kb.Magic[:], []byte(CHROMEOS_MAGIC)) ||
+		uint64(kb.KeyblockSize) != uint64(len(chromeosKeyblock)) {
+		return nil, errors.New("invalid vboot keyblock")
+	}
+
+	// Kernel blob: kernel | config | params | bootloader
+	kernel_sz := align_to(uint64(len(image)), CROS_ALIGN)
+	blob := make([]byte, kernel_sz+CROS_CONFIG_SIZE+CROS_PARAMS_SIZE)
+	copy(blob, image)
+	bootloader_addr := CROS_32BIT_ENTRY_ADDR + kernel_sz + CROS_CONFIG_SIZE + CROS_PARAMS_SIZE
+
+	body_sig, err := vb2Sign(blob, key, alg)
+	if err != nil {
+		return nil, err
+	}
+
+	pre := Vb2KernelPreamble{
+		HeaderVersionMajor: VB2_KERNEL_PREAMBLE_HEADER_VERSION_MAJOR,
+		HeaderVersionMinor: VB2_KERNEL_PREAMBLE_HEADER_VERSION_MINOR,
+		KernelVersion:      1,
+		BodyLoadAddress:    CROS_32BIT_ENTRY_ADDR,
+		BootloaderAddress:  bootloader_addr,
+		Flags:              1,
+	}
+	pre_sz := uint32(binary.Size(pre))
+	signed_sz := pre_sz + uint32(len(body_sig))
+	pre.PreambleSize = uint32(CHROMEOS_HDR_SZ - len(chromeosKeyblock))
+	if signed_sz+uint32(key.Size()) > pre.PreambleSize {
+		return nil, errors.New("vboot keyblock too large")
+	}
+	// Offset of body_signature in the preamble is 72
+	const body_sig_off = 72
+	pre.BodySignature = Vb2Signature{
+		SigOffset: pre_sz - body_sig_off,
+		SigSize:   uint32(len(body_sig)),
+		DataSize:  uint32(len(blob)),
+	}
+	// Offset of preamble_signature in the preamble is 8
+	pre.PreambleSignature = Vb2Signature{
+		SigOffset: signed_sz - 8,
+		SigSize:   uint32(key.Size()),
+		DataSize:  signed_sz,
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, &pre)
+	buf.Write(body_sig)
+	pre_sig, err := vb2Sign(buf.Bytes(), key, alg)
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(pre_sig)
+	buf.Write(make([]byte, int(pre.PreambleSize)-buf.Len()))
+
+	out := bytes.NewBuffer(bytes.Clone(chromeosKeyblock))
+	out.Write(buf.Bytes())
+	out.Write(blob)
+	return out.Bytes(), nil
+}
@@ -0,0 +1,80 @@
+package magiskboot_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"magiskboot"
+	"math/big"
+	"os"
+	"slices"
+	"testing"
+)
+
+func verifyVb2(t *testing.T, pub *rsa.PublicKey, data, sig []byte) {
+	digest := sha256.Sum256(data)
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+		t.Fatalf("Verify vboot signature, Except: %v, But: %v", nil, err)
+	}
+}
+
+func TestChromeOS(t *testing.T) {
+	t.Log("Test ChromeOS unpack and repack")
+	t.Chdir(t.TempDir())
+
+	img, err := magiskboot.SignChromeOS(makeBootImgV2(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("boot.img", img, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if ret := unpack(t, "boot.img", false, false); ret != 2 {
+		t.Fatalf("Unpack chromeos, Except: 2, But: %v", ret)
+	}
+	checkFiles(t, map[string][]byte{
+		magiskboot.KERNEL_FILE:  testKernel,
+		magiskboot.RAMDISK_FILE: testRamdisk,
+	})
+
+	os.WriteFile(magiskboot.RAMDISK_FILE, []byte("070701 new ramdisk"), 0644)
+	repack(t, "boot.img", "new-boot.img", false)
+	out, err := os.ReadFile("new-boot.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Parse keyblock and the public data key
+	var kb magiskboot.Vb2Keyblock
+	binary.Read(bytes.NewReader(out), binary.LittleEndian, &kb)
+	if string(kb.Magic[:]) != magiskboot.CHROMEOS_MAGIC {
+		t.Fatalf("Keyblock magic, Except: %v, But: %v", magiskboot.CHROMEOS_MAGIC, kb.Magic)
+	}
+	key := out[80+kb.DataKey.KeyOffset:]
+	words := binary.LittleEndian.Uint32(key)
+	n := slices.Clone(key[8 : 8+words*4])
+	slices.Reverse(n)
+	pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537}
+
+	// Check preamble and body signatures
+	pre := out[kb.KeyblockSize:]
+	var p magiskboot.Vb2KernelPreamble
+	binary.Read(bytes.NewReader(pre), binary.LittleEndian, &p)
+	psig := p.PreambleSignature
+	verifyVb2(t, pub, pre[:psig.DataSize], pre[8+psig.SigOffset:][:psig.SigSize])
+	body := out[magiskboot.CHROMEOS_HDR_SZ:]
+	bsig := p.BodySignature
+	verifyVb2(t, pub, body[:bsig.DataSize], pre[72+bsig.SigOffset:][:bsig.SigSize])
+
+	boot := loadBootImg(t, "new-boot.img")
+	defer boot.Close()
+	if !boot.Flags[magiskboot.CHROMEOS_FLAG] {
+		t.Fatalf("CHROMEOS_FLAG, Except: %v, But: %v", true, false)
+	}
+	if !bytes.Equal(boot.Ramdisk, []byte("070701 new ramdisk")) {
+		t.Fatalf("Ramdisk mismatch, Except: %q, But: %q", "070701 new ramdisk", boot.Ramdisk)
+	}
+}
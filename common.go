@@ -1,5 +1,11 @@
 package magiskboot
 
+import (
+	"bytes"
+	"os"
+	"strings"
+)
+
 func align_to(v uint64, a uint64) uint64 {
 	return (v + a - 1) / a * a
 }
@@ -7,3 +13,34 @@ func align_to(v uint64, a uint64) uint64 {
 func align_padding(v, a uint64) uint64 {
 	return align_to(v, a) - v
 }
+
+// Convert a NUL terminated byte array to string
+func cstr(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return string(b[:i])
+	}
+	return string(b)
+}
+
+// Parse file with key=value lines, empty lines and comments are skipped.
+// Stops at the first error returned by fn.
+func parsePropFile(file string, fn func(key, value string) error) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		if err := fn(strings.TrimSpace(key), strings.TrimSpace(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,13 +1,14 @@
 package magiskboot
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -27,66 +28,90 @@ type Encoder struct {
 	writeCloser io.WriteCloser
 }
 
+// Writer of the lz4 legacy format, input is compressed in blocks of
+// LZ4_UNCOMPRESSED bytes. The LG variant ends with the uncompressed size.
 type Lz4HCWriter struct {
 	*lz4.CompressorHC
 
 	writer io.Writer
 	lg     bool
 
+	in  []byte
 	buf []byte
 
 	in_total uint32
 }
 
-func NewLz4HCWriter(writer io.Writer, lg bool) *Lz4HCWriter {
+func NewLz4HCWriter(writer io.Writer, lg bool) (*Lz4HCWriter, error) {
 	z := new(Lz4HCWriter)
 	z.CompressorHC = &lz4.CompressorHC{
 		Level: lz4.Level9,
 	}
 	z.writer = writer
 	z.lg = lg
+	z.in = make([]byte, 0, LZ4_UNCOMPRESSED)
 	z.buf = make([]byte, LZ4_COMPRESSED)
 
-	writer.Write([]byte{0x02, 0x21, 0x4c, 0x18})
+	if _, err := writer.Write([]byte{0x02, 0x21, 0x4c, 0x18}); err != nil {
+		return nil, err
+	}
 
-	return z
+	return z, nil
 }
 
 func (z *Lz4HCWriter) Write(data []byte) (int, error) {
-	var write_len = 0
-	var block_sz uint32
+	write_len := 0
+	for len(data) > 0 {
+		n := min(len(data), LZ4_UNCOMPRESSED-len(z.in))
+		z.in = append(z.in, data[:n]...)
+		data = data[n:]
+		write_len += n
+		if len(z.in) == LZ4_UNCOMPRESSED {
+			if err := z.flush(); err != nil {
+				return write_len, err
+			}
+		}
+	}
+	return write_len, nil
+}
 
-	sz, err := z.CompressBlock(data, z.buf)
+// Compress buffered input into a block
+func (z *Lz4HCWriter) flush() error {
+	if len(z.in) == 0 {
+		return nil
+	}
+	sz, err := z.CompressBlock(z.in, z.buf)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
 
-	block_sz = uint32(sz)
+	block_sz := uint32(sz)
 
 	if block_sz == 0 {
-		log.Fatalln("LZ4HC compression failure")
+		return errors.New("LZ4HC compression failure")
 	}
-	binary.Write(z.writer, binary.LittleEndian, &block_sz)
-	write_len += binary.Size(block_sz)
-
-	l, err := z.writer.Write(z.buf[:block_sz])
-	if err != nil {
-		log.Fatalln(err)
+	if err := binary.Write(z.writer, binary.LittleEndian, &block_sz); err != nil {
+		return err
 	}
-	write_len += l
-	z.in_total += uint32(len(data))
-
-	return write_len, err
+	if _, err := z.writer.Write(z.buf[:block_sz]); err != nil {
+		return err
+	}
+	z.in_total += uint32(len(z.in))
+	z.in = z.in[:0]
+	return nil
 }
 
 func (z *Lz4HCWriter) Close() error {
+	if err := z.flush(); err != nil {
+		return err
+	}
 	if z.lg {
 		return binary.Write(z.writer, binary.LittleEndian, &z.in_total)
 	}
 	return nil
 }
 
-func NewEncoder(t format_t, writer io.Writer) *Encoder {
+func NewEncoder(t format_t, writer io.Writer) (*Encoder, error) {
 	encoder := new(Encoder)
 	var w io.WriteCloser = nil
 	var err error = nil
@@ -108,22 +133,22 @@ func NewEncoder(t format_t, writer io.Writer) *Encoder {
 			lz4.CompressionLevelOption(lz4.Level9),
 			lz4.ChecksumOption(true))
 	case LZ4_LEGACY:
-		w = NewLz4HCWriter(writer, false)
+		w, err = NewLz4HCWriter(writer, false)
 	case LZ4_LG:
-		w = NewLz4HCWriter(writer, true)
-	case ZOPFLI: // not support
-		panic("compress: not impl zopfli on this magiskboot")
+		w, err = NewLz4HCWriter(writer, true)
 	case GZIP:
 		w = gzip.NewWriter(writer)
+	default: // zopfli is not supported on this magiskboot
+		return nil, unsupported("cannot compress to %s", Fmt2Name(t))
 	}
 
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
 
 	encoder.writeCloser = w
 
-	return encoder
+	return encoder, nil
 }
 
 func (e *Encoder) Write(data []byte) (int, error) {
@@ -139,7 +164,171 @@ type Decoder struct {
 	closer io.Closer
 }
 
-func NewDecoder(t format_t, reader io.Reader) *Decoder {
+// Reader of the lz4 legacy format. Blocks end at anything that is not a block,
+// like the uncompressed size of the LG variant or trailing data.
+type Lz4LegacyReader struct {
+	reader io.Reader
+
+	buf  []byte
+	data []byte
+	out  []byte
+	eof  bool
+
+	out_total uint32
+}
+
+func NewLz4LegacyReader(reader io.Reader) (*Lz4LegacyReader, error) {
+	magic := make([]byte, len(LZ4_LEG_MAGIC))
+	if _, err := io.ReadFull(reader, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != LZ4_LEG_MAGIC {
+		return nil, badMagic("input is not in lz4 legacy format")
+	}
+	z := new(Lz4LegacyReader)
+	z.reader = reader
+	z.buf = make([]byte, LZ4_COMPRESSED)
+	z.data = make([]byte, LZ4_UNCOMPRESSED)
+	return z, nil
+}
+
+func (z *Lz4LegacyReader) Read(data []byte) (int, error) {
+	for len(z.out) == 0 {
+		if z.eof {
+			return 0, io.EOF
+		}
+		if err := z.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(data, z.out)
+	z.out = z.out[n:]
+	return n, nil
+}
+
+// Decompress the next block into z.out
+func (z *Lz4LegacyReader) next() error {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(z.reader, hdr); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			z.eof = true
+			return nil
+		}
+		return err
+	}
+	if string(hdr) == LZ4_LEG_MAGIC {
+		// Concatenated stream
+		return nil
+	}
+	block_sz := binary.LittleEndian.Uint32(hdr)
+	if block_sz == 0 || block_sz > uint32(LZ4_COMPRESSED) || block_sz == z.out_total {
+		z.eof = true
+		return nil
+	}
+	if _, err := io.ReadFull(z.reader, z.buf[:block_sz]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	n, err := lz4.UncompressBlock(z.buf[:block_sz], z.data)
+	if err != nil {
+		return err
+	}
+	z.out = z.data[:n]
+	z.out_total += uint32(n)
+	return nil
+}
+
+// Reader of concatenated gzip members, stops at anything that is not a member
+type gzipReader struct {
+	*gzip.Reader
+	in *bufio.Reader
+}
+
+func newGzipReader(reader io.Reader) (*gzipReader, error) {
+	// gzip reads exactly the member from an io.ByteReader
+	in := bufio.NewReader(reader)
+	r, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, err
+	}
+	r.Multistream(false)
+	return &gzipReader{Reader: r, in: in}, nil
+}
+
+func (z *gzipReader) Read(data []byte) (int, error) {
+	for {
+		n, err := z.Reader.Read(data)
+		if err != io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+		if magic, _ := z.in.Peek(2); CheckFmt(magic) != GZIP {
+			return 0, io.EOF
+		}
+		if err := z.Reader.Reset(z.in); err != nil {
+			return 0, err
+		}
+		z.Reader.Multistream(false)
+	}
+}
+
+// Reader of a single xz stream, trailing data after the stream is ignored
+type xzReader struct {
+	*xz.Reader
+	in *xzInput
+}
+
+// Input of xzReader, keeps the last bytes read to check the stream footer
+type xzInput struct {
+	reader io.Reader
+	tail   []byte
+}
+
+const xzFooterSize = 12
+
+// Whether the last bytes read are a stream footer:
+// CRC32 of the next 6 bytes, backward size, stream flags and magic
+func (r *xzInput) footer() bool {
+	if len(r.tail) < xzFooterSize || string(r.tail[10:]) != "YZ" {
+		return false
+	}
+	return binary.LittleEndian.Uint32(r.tail) == crc32.ChecksumIEEE(r.tail[4:10])
+}
+
+func (r *xzInput) Read(data []byte) (int, error) {
+	if r.footer() {
+		// The stream is complete, hide trailing data from xz
+		return 0, io.EOF
+	}
+	n, err := r.reader.Read(data)
+	r.tail = append(r.tail, data[:n]...)
+	r.tail = r.tail[max(0, len(r.tail)-xzFooterSize):]
+	return n, err
+}
+
+func newXzReader(reader io.Reader) (*xzReader, error) {
+	in := &xzInput{reader: reader}
+	r, err := xz.ReaderConfig{SingleStream: true}.NewReader(in)
+	if err != nil {
+		return nil, err
+	}
+	return &xzReader{Reader: r, in: in}, nil
+}
+
+func (r *xzReader) Read(data []byte) (int, error) {
+	n, err := r.Reader.Read(data)
+	if err == io.EOF && !r.in.footer() {
+		// xz ends quietly if the stream is cut before a block header
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func NewDecoder(t format_t, reader io.Reader) (*Decoder, error) {
 	decoder := new(Decoder)
 	var r io.Reader = nil
 	var err error = nil
@@ -149,7 +338,7 @@ func NewDecoder(t format_t, reader io.Reader) *Decoder {
 
 	switch t {
 	case XZ:
-		r, err = xz.NewReader(reader)
+		r, err = newXzReader(reader)
 	case LZMA:
 		r, err = lzma.NewReader(reader)
 	case BZIP2:
@@ -157,18 +346,22 @@ func NewDecoder(t format_t, reader io.Reader) *Decoder {
 	case LZ4:
 		r = lz4.NewReader(reader)
 	case LZ4_LEGACY, LZ4_LG:
-		r = lz4.NewReader(reader)
+		r, err = NewLz4LegacyReader(reader)
 	case ZOPFLI, GZIP:
-		r, err = gzip.NewReader(reader)
+		var gr *gzipReader
+		gr, err = newGzipReader(reader)
 		if err == nil {
-			decoder.closer = r.(io.Closer)
+			r = gr
+			decoder.closer = gr
 		}
+	default:
+		return nil, unsupported("cannot decompress %s", Fmt2Name(t))
 	}
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
 	decoder.reader = r
-	return decoder
+	return decoder, nil
 }
 
 func (d *Decoder) Decode() ([]byte, error) {
@@ -189,113 +382,90 @@ func (d *Decoder) Close() error {
 	return nil
 }
 
-func Compress(method, infile, outfile string) {
+func Compress(method, infile, outfile string) error {
 	t := Name2Fmt(method)
 	if t == UNKNOWN {
-		log.Fatalln("Unknow compression method: ", method)
+		return unsupported("unknown compression method: %s", method)
 	}
 
 	in_std := infile == "-"
 	rm_in := false
 
-	in_fd := func() *os.File {
-		if in_std {
-			return os.Stdin
-		} else {
-			file, err := os.Open(infile)
-			if err != nil {
-				log.Fatalln(err)
-			}
-			return file
+	in_fd := os.Stdin
+	if !in_std {
+		file, err := os.Open(infile)
+		if err != nil {
+			return err
 		}
-	}()
+		defer file.Close()
+		in_fd = file
+	}
 
-	var out_fd *os.File = nil
+	out_fd := os.Stdout
 	if outfile == "" {
-		if in_std {
-			out_fd = os.Stdout
-		} else {
-			var err error = nil
-			tmp := infile + Fmt2Ext(t)
-			out_fd, err = os.Create(tmp)
-			if err != nil {
-				log.Fatalln(err)
-			}
-			fmt.Fprintf(os.Stderr, "Compressing to [%s]\n", tmp)
+		if !in_std {
+			outfile = infile + Fmt2Ext(t)
+			fmt.Fprintf(os.Stderr, "Compressing to [%s]\n", outfile)
 			rm_in = true
 		}
-	} else {
-		out_fd = func() *os.File {
-			if outfile == "-" {
-				return os.Stdout
-			} else {
-				file, err := os.Create(outfile)
-				if err != nil {
-					log.Fatalln(err)
-				}
-				return file
-			}
-		}()
 	}
-
-	encoder := NewEncoder(t, out_fd)
-
-	buf := make([]byte, 4096)
-	for {
-		l, err := in_fd.Read(buf)
-
-		if _, err := encoder.Write(buf[:l]); err != nil {
-			log.Fatalln(err)
-		}
-
+	if outfile != "" && outfile != "-" {
+		file, err := os.Create(outfile)
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			log.Fatalln(err)
+			return err
 		}
+		defer file.Close()
+		out_fd = file
 	}
-	encoder.Close()
 
-	if in_fd != os.Stdin {
-		in_fd.Close()
+	encoder, err := NewEncoder(t, out_fd)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(encoder, in_fd); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
 	}
 
 	if out_fd != os.Stdout {
-		out_fd.Close()
+		if err := out_fd.Close(); err != nil {
+			return err
+		}
 	}
 
 	if rm_in {
-		os.Remove(infile)
+		in_fd.Close()
+		return os.Remove(infile)
 	}
+	return nil
 }
 
-func Decompress(infile, outfile string) {
+func Decompress(infile, outfile string) error {
 	in_std := infile == "-"
 	rm_in := false
 
-	in_fd := func() *os.File {
-		if in_std {
-			return os.Stdin
-		}
+	in_fd := os.Stdin
+	if !in_std {
 		file, err := os.Open(infile)
 		if err != nil {
-			log.Fatalln(err)
+			return err
 		}
-		return file
-	}()
-	//defer in_fd.Close()
+		defer file.Close()
+		in_fd = file
+	}
 
-	buf := make([]byte, 4096)
-	_, err := in_fd.Read(buf)
-	if err != nil {
-		log.Fatalln(err)
+	// Peek the header to detect the format
+	in := bufio.NewReaderSize(in_fd, 4096)
+	buf, err := in.Peek(4096)
+	if err != nil && err != io.EOF {
+		return err
 	}
-	in_fd.Seek(0, io.SeekStart)
 
 	t := CheckFmt(buf)
 	if !COMPRESSED(t) {
-		log.Fatalln("Input file is not a supported compressed type!")
+		return badMagic("input file is not a supported compressed type")
 	}
 
 	if outfile == "" {
@@ -304,129 +474,86 @@ func Decompress(infile, outfile string) {
 			ext := filepath.Ext(infile)
 			if ext != "" {
 				if ext != Fmt2Ext(t) {
-					log.Fatalln("Input file is not a supported type!")
+					return unsupported("input file is not a supported type")
 				}
 
-				outfile = strings.TrimRight(infile, ext)
+				outfile = strings.TrimSuffix(infile, ext)
 				rm_in = true
 				fmt.Fprintf(os.Stderr, "Decompressing to [%s]\n", outfile)
 			}
 		}
 	}
 
-	out_fd := func() *os.File {
-		if outfile == "-" {
-			return os.Stdout
-		}
+	out_fd := os.Stdout
+	if outfile != "-" {
 		file, err := os.Create(outfile)
 		if err != nil {
-			log.Fatalln(err)
+			return err
 		}
-		return file
-	}()
+		defer file.Close()
+		out_fd = file
+	}
 
-	decoder := NewDecoder(t, in_fd)
+	decoder, err := NewDecoder(t, in)
+	if err != nil {
+		return err
+	}
 	defer decoder.Close()
-	/*
-		decompressed, err := decoder.Decode()
-		if err != nil {
-			log.Fatalln("Decompression error\n", err)
-		}
-
-		_, err = out_fd.Write(decompressed)
-		if err != nil {
-			log.Fatalln(err)
-		}
-	*/
-	//buf = make([]byte, 4096)
-	for {
-		// 读取数据
-		_len, err := decoder.Read(buf)
-		if _len > 0 {
-			// 写入读取到的数据
-			_, writeErr := out_fd.Write(buf[:_len])
-			if writeErr != nil {
-				log.Fatalln("Write error:", writeErr)
-			}
-		}
-
-		// 处理错误
-		if err != nil {
-			if err == io.EOF {
-				break // 正常结束
-			}
-			log.Fatalln("Read error:", err)
-		}
+	if _, err := io.Copy(out_fd, decoder); err != nil {
+		return err
 	}
 
-	if in_fd != os.Stdin {
-		in_fd.Close()
-	}
 	if out_fd != os.Stdout {
-		out_fd.Close()
+		if err := out_fd.Close(); err != nil {
+			return err
+		}
 	}
 
 	if rm_in {
-		os.Remove(infile)
+		in_fd.Close()
+		return os.Remove(infile)
 	}
+	return nil
 }
 
-func DecompressToFd(data []byte, fd *os.File) bool {
+func DecompressToFd(data []byte, fd io.Writer) error {
 	t := CheckFmt(data)
 
 	if !COMPRESSED(t) {
-		log.Println("Input file is not a supported compression format!")
-		return false
-	}
-
-	decoder := NewDecoder(t, bytes.NewReader(data))
-	d, err := decoder.Decode()
-	if err != nil {
-		log.Fatalln(err)
+		return badMagic("input file is not a supported compression format")
 	}
 
-	_, err = fd.Write(d)
+	decoder, err := NewDecoder(t, bytes.NewReader(data))
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
-	return true
+	defer decoder.Close()
+	_, err = io.Copy(fd, decoder)
+	return err
 }
 
-func Xz(data []byte, compressed *[]byte) bool {
-	bufferc := new(bytes.Buffer)
-	xzwriter, err := xz.NewWriter(bufferc)
+func Xz(data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w, err := xz.NewWriter(buf)
 	if err != nil {
-		log.Println("Error:", err)
-		return false
+		return nil, err
 	}
-	defer xzwriter.Close()
-	_, err = xzwriter.Write(data)
-	if err != nil {
-		log.Println("Error:", err)
-		return false
+	if _, err := w.Write(data); err != nil {
+		return nil, err
 	}
-	*compressed = bufferc.Bytes()
-	return true
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
-func Unxz(data []byte, decompressed *[]byte) bool {
-	t := CheckFmt(data)
-	if t != XZ {
-		log.Println("Input file is not in xz format!")
-		return false
-	}
-	buffer := bytes.NewBuffer(data)
-	xzreader, err := xz.NewReader(buffer)
-	if err != nil {
-		log.Println("Error:", err)
-		return false
+func Unxz(data []byte) ([]byte, error) {
+	if CheckFmt(data) != XZ {
+		return nil, badMagic("input is not in xz format")
 	}
-
-	d, err := io.ReadAll(xzreader)
+	r, err := xz.NewReader(bytes.NewReader(data))
 	if err != nil {
-		log.Println("Error:", err)
-		return false
+		return nil, err
 	}
-	*decompressed = d
-	return true
+	return io.ReadAll(r)
 }
@@ -7,7 +7,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"magiskboot/stub"
 	"os"
 	"path"
@@ -155,6 +154,14 @@ func norm_path(p string) string { /// dirty impl
 	return strings.TrimLeft(path.Clean(p), "/")
 }
 
+// Normalized path of an entry, the root directory is not an entry
+func entryPath(p string) (string, error) {
+	if n := norm_path(p); n != "" && n != "." {
+		return n, nil
+	}
+	return "", fmt.Errorf("invalid cpio entry path: %q", p)
+}
+
 func (c *Cpio) LoadFromData(data []byte) error {
 	//c = NewCpio()
 	pos := uint64(0)
@@ -162,16 +169,20 @@ func (c *Cpio) LoadFromData(data []byte) error {
 	for pos < uint64(len(data)) {
 		hdr_sz := binary.Size(CpioHeader{})
 		hdr := CpioHeader{}
-		reader := bytes.NewReader(data[pos : pos+uint64(hdr_sz)])
-		binary.Read(reader, binary.LittleEndian, &hdr)
+		if err := readHdr(data[pos:], &hdr); err != nil {
+			return err
+		}
 		if !bytes.Equal(hdr.Magic[:], []byte("070701")) {
-			return errors.New("invalid cpio magic")
+			return badMagic("invalid cpio magic at 0x%x", pos)
 		}
 		pos += uint64(hdr_sz)
 		name_sz, err := x8u(hdr.Namesize[:])
 		if err != nil {
 			return err
 		}
+		if uint64(name_sz) > uint64(len(data))-pos {
+			return truncated("cpio entry name at 0x%x", pos)
+		}
 		name := strings.TrimRight(string(data[pos:pos+uint64(name_sz)]), "\x00")
 		pos += uint64(name_sz)
 		pos = align_4(pos)
@@ -188,6 +199,9 @@ func (c *Cpio) LoadFromData(data []byte) error {
 			continue
 		}
 		file_sz, _ := x8u(hdr.Filesize[:])
+		if pos > uint64(len(data)) || uint64(file_sz) > uint64(len(data))-pos {
+			return truncated("cpio entry [%s] data", name)
+		}
 		xx8u := func(x [8]byte) uint32 {
 			u, _ := x8u(x[:])
 			return u
@@ -222,11 +236,11 @@ func (c *Cpio) LoadFromFile(path string) error {
 	c.mm = &m
 	// It looks we has been loaded all file into cpio struture...
 	// Do not forget to close all these
-	c.LoadFromData(m)
+	err = c.LoadFromData(m)
 
 	// When reading done, close
 	c.Close()
-	return nil
+	return err
 }
 
 func (c *Cpio) Close() {
@@ -236,13 +250,10 @@ func (c *Cpio) Close() {
 	c.fd.Close()
 }
 
-func writeZeros(fd io.Writer, pos uint64) uint64 {
+func writeZeros(fd io.Writer, pos uint64) (uint64, error) {
 	buf := make([]byte, align_4(pos)-pos)
 	write_len, err := fd.Write(buf)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	return uint64(write_len)
+	return uint64(write_len), err
 }
 
 // It seems create a cpio file
@@ -284,11 +295,15 @@ func (c *Cpio) Dump(path string) error {
 		pos += uint64(write_len)
 		write_len, _ = file.Write([]byte{0})
 		pos += uint64(write_len)
-		pos += writeZeros(file, pos)
+		if _, err := writeZeros(file, pos); err != nil {
+			return err
+		}
 		pos = align_4(pos)
 		write_len, _ = file.Write(entry.Data)
 		pos += uint64(write_len)
-		writeZeros(file, pos)
+		if _, err := writeZeros(file, pos); err != nil {
+			return err
+		}
 		pos = align_4(pos)
 		inode += 1
 	}
@@ -297,13 +312,18 @@ func (c *Cpio) Dump(path string) error {
 	pos += uint64(write_len)
 	write_len, _ = file.Write([]byte("TRAILER!!!\x00"))
 	pos += uint64(write_len)
-	writeZeros(file, pos)
+	if _, err := writeZeros(file, pos); err != nil {
+		return err
+	}
 
-	return nil
+	return file.Close()
 }
 
-func (c *Cpio) Rm(path string, recursive bool) {
-	path = norm_path(path)
+func (c *Cpio) Rm(path string, recursive bool) error {
+	path, err := entryPath(path)
+	if err != nil {
+		return err
+	}
 	removeByValue := func(slice []string, value string) []string {
 		for i, v := range slice {
 			if v == value {
@@ -335,11 +355,12 @@ func (c *Cpio) Rm(path string, recursive bool) {
 			}
 		}
 	}
+	return nil
 }
 
 func (c *Cpio) extractEntry(p, out string) error {
 	if !slices.Contains(c.Keys, p) {
-		log.Fatalln("No such file")
+		return fmt.Errorf("no such file [%s]", p)
 	}
 
 	entry := c.Entries[p]
@@ -420,36 +441,27 @@ func (c *Cpio) Add(mode uint32, path string, file string) error {
 	rdevmajor := uint64(0)
 	rdevminor := uint64(0)
 
-	mode = func() uint32 {
-		if attr.Mode().IsRegular() || (attr.Mode()&os.ModeSymlink != 0) {
-			rdevmajor = 0
-			rdevminor = 0
-			content, err = os.ReadFile(file)
-			if err != nil {
-				log.Fatalln(err)
-			}
-			return mode | S_IFREG
+	if attr.Mode().IsRegular() || (attr.Mode()&os.ModeSymlink != 0) {
+		content, err = os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		mode = mode | S_IFREG
+	} else if runtime.GOOS != "windows" {
+		uattr := stub.Stat_t{}
+		if err := stub.Stat(file, &uattr); err != nil {
+			return err
+		}
+		rdevmajor = uint64(stub.Major(uint64(uattr.Rdev)))
+		rdevminor = uint64(stub.Minor(uint64(uattr.Rdev)))
+		if attr.Mode()&os.ModeCharDevice != 0 {
+			mode = mode | S_IFCHR
+		} else if attr.Mode()&os.ModeDevice != 0 {
+			mode = mode | S_IFBLK
 		} else {
-			if runtime.GOOS != "windows" {
-				uattr := stub.Stat_t{}
-				err = stub.Stat(file, &uattr)
-				//uattr := &attr
-				if err != nil {
-					log.Fatalln(err)
-				}
-				rdevmajor = uint64(stub.Major(uint64(uattr.Rdev)))
-				rdevminor = uint64(stub.Minor(uint64(uattr.Rdev)))
-				if attr.Mode()&os.ModeDevice != 0 {
-					mode = mode | S_IFBLK
-				} else if attr.Mode()&os.ModeCharDevice != 0 {
-					mode = mode | S_IFCHR
-				} else {
-					log.Fatalln("unsupport file type")
-				}
-			}
+			return unsupported("file type of %s", file)
 		}
-		return mode
-	}()
+	}
 
 	c.addEntry(norm_path(path), CpioEntry{
 		Mode:      mode,
@@ -463,8 +475,12 @@ func (c *Cpio) Add(mode uint32, path string, file string) error {
 	return nil
 }
 
-func (c *Cpio) Mkdir(mode uint32, dir string) {
-	c.addEntry(norm_path(dir), CpioEntry{
+func (c *Cpio) Mkdir(mode uint32, dir string) error {
+	name, err := entryPath(dir)
+	if err != nil {
+		return err
+	}
+	c.addEntry(name, CpioEntry{
 		Mode:      mode | S_IFDIR,
 		Uid:       0,
 		Gid:       0,
@@ -473,10 +489,15 @@ func (c *Cpio) Mkdir(mode uint32, dir string) {
 		Data:      []byte{},
 	})
 	fmt.Fprintf(os.Stderr, "Create directory [%s] (%04o)\n", dir, mode)
+	return nil
 }
 
-func (c *Cpio) Ln(src, dst string) {
-	c.addEntry(norm_path(dst), CpioEntry{
+func (c *Cpio) Ln(src, dst string) error {
+	name, err := entryPath(dst)
+	if err != nil {
+		return err
+	}
+	c.addEntry(name, CpioEntry{
 		Mode:      S_IFLNK,
 		Uid:       0,
 		Gid:       0,
@@ -491,6 +512,7 @@ func (c *Cpio) Ln(src, dst string) {
 		}(),
 	})
 	fmt.Fprintf(os.Stderr, "Create symlink [%s] -> [%s]\n", dst, src)
+	return nil
 }
 
 func (c *Cpio) Mv(from, to string) error {
@@ -510,7 +532,7 @@ func (c *Cpio) Mv(from, to string) error {
 	return nil
 }
 
-func (c *Cpio) Ls(path string, recursive bool) {
+func (c *Cpio) Ls(path string, recursive bool) error {
 	path = norm_path(path)
 	if path != "" {
 		path = "/" + path
@@ -530,8 +552,11 @@ func (c *Cpio) Ls(path string, recursive bool) {
 			continue
 		}
 		//fmt.Printf("%s\n", name)
-		fmt.Fprintf(os.Stdout, "%v\t%s\n", entry, name)
+		if _, err := fmt.Fprintf(os.Stdout, "%v\t%s\n", entry, name); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 // Make cpio.ls print formatable
@@ -603,36 +628,36 @@ func (entry CpioEntry) Format(f fmt.State, verb rune) {
 	))
 }
 
-func (entry *CpioEntry) Compress() bool {
+// Compress a regular file entry with xz, returns whether it is compressed
+func (entry *CpioEntry) Compress() (bool, error) {
 	if entry.Mode&S_IFMT != S_IFREG {
-		return false
+		return false, nil
 	}
-	compressed := make([]byte, 0)
-	if !Xz(entry.Data, &compressed) {
-		fmt.Fprintln(os.Stderr, "xz compression failed")
-		return false
+	compressed, err := Xz(entry.Data)
+	if err != nil {
+		return false, err
 	}
 	entry.Data = compressed
-	return true
+	return true, nil
 }
 
-func (entry *CpioEntry) Decompress() bool {
+// Decompress a regular file entry with xz, returns whether it is decompressed
+func (entry *CpioEntry) Decompress() (bool, error) {
 	if entry.Mode&S_IFMT != S_IFREG {
-		return false
+		return false, nil
 	}
-	decompressed := make([]byte, 0)
-	if !Unxz(entry.Data, &decompressed) {
-		fmt.Fprintln(os.Stderr, "xz decompression failed")
-		return false
+	decompressed, err := Unxz(entry.Data)
+	if err != nil {
+		return false, err
 	}
 	entry.Data = decompressed
-	return true
+	return true, nil
 }
 
 const MAGISK_PATCHED int32 = 1 << 0
 const UNSUPPORTED_CPIO int32 = 1 << 1
 
-func (c *Cpio) Patch() {
+func (c *Cpio) Patch() error {
 	keep_verity := CheckEnv("KEEPVERITY")
 	keep_force_encrypt := CheckEnv("KEEPFORCEENCRYPT")
 	fmt.Fprintf(os.Stderr, "Patch with flag KEEPVERITY=[%v] KEEPFORCEENCRYPT=[%v]\n",
@@ -653,13 +678,16 @@ func (c *Cpio) Patch() {
 				fmt.Fprintf(os.Stderr, "Found fstab file [%s]\n", name)
 				entry.Data = PatchVerity(entry.Data)
 			} else if name == "verity_key" {
-				c.Rm(name, false)
+				if err := c.Rm(name, false); err != nil {
+					return err
+				}
 			}
 		}
 		if !keep_force_encrypt && fstab {
 			entry.Data = PatchEncryption(entry.Data)
 		}
 	}
+	return nil
 }
 
 func (c *Cpio) Test() int32 {
@@ -699,18 +727,23 @@ func (c *Cpio) Restore() error {
 					return err
 				}
 			} else if name != ".backup/.magisk" {
-				new_name := func() string {
-					if strings.HasSuffix(name, ".xz") && entry.Decompress() {
-						return name[8 : len(name)-3]
-					} else {
-						return name[8:]
+				new_name := name[8:]
+				if strings.HasSuffix(name, ".xz") {
+					decompressed, err := entry.Decompress()
+					if err != nil {
+						return fmt.Errorf("failed to decompress %s: %w", name, err)
 					}
-				}()
+					if decompressed {
+						new_name = name[8 : len(name)-3]
+					}
+				}
 				backups[new_name] = entry
 			}
 		}
 	}
-	c.Rm(".backup", false)
+	if err := c.Rm(".backup", false); err != nil {
+		return err
+	}
 	if rm_list.Len() == 0 && len(backups) == 0 {
 		for k := range c.Entries {
 			delete(c.Entries, k)
@@ -720,7 +753,9 @@ func (c *Cpio) Restore() error {
 
 	for _, rm := range strings.Split(rm_list.String(), "\x00") {
 		if len(rm) != 0 {
-			c.Rm(rm, false)
+			if err := c.Rm(rm, false); err != nil {
+				return err
+			}
 		}
 	}
 	for k, v := range backups {
@@ -744,11 +779,16 @@ func (c *Cpio) Backup(origin string, skip_compress bool) error {
 		Data:      []byte{},
 	}
 	o := NewCpio()
-	o.LoadFromFile(origin)
-	o.Close()
+	if err := o.LoadFromFile(origin); err != nil {
+		return err
+	}
 
-	o.Rm(".backup", true)
-	c.Rm(".backup", true)
+	if err := o.Rm(".backup", true); err != nil {
+		return err
+	}
+	if err := c.Rm(".backup", true); err != nil {
+		return err
+	}
 
 	lhs := o.Entries
 	rhs := c.Entries
@@ -757,14 +797,21 @@ func (c *Cpio) Backup(origin string, skip_compress bool) error {
 
 	lhsIndex, rhsIndex := 0, 0
 
-	backupFunc := func(name string, entry CpioEntry) {
+	backupFunc := func(name string, entry CpioEntry) error {
 		backupPath := ".backup/" + name
-		if !skip_compress && entry.Compress() {
-			backupPath += ".xz"
+		if !skip_compress {
+			compressed, err := entry.Compress()
+			if err != nil {
+				return fmt.Errorf("failed to compress %s: %w", name, err)
+			}
+			if compressed {
+				backupPath += ".xz"
+			}
 		}
 		fmt.Fprintf(os.Stderr, "Backup [%s] -> [%s]\n", name, backupPath)
 		// 需要实际将entry添加到backups map中
 		backups[name] = entry
+		return nil
 	}
 
 	recordFunc := func(name string) {
@@ -781,12 +828,16 @@ func (c *Cpio) Backup(origin string, skip_compress bool) error {
 		switch cmp.Compare(lKey, rKey) {
 		case -1: // lhs < rhs
 			le := lhs[lKey]
-			backupFunc(lKey, le)
+			if err := backupFunc(lKey, le); err != nil {
+				return err
+			}
 			lhsIndex++
 		case 0: // lhs == rhs
 			le := lhs[lKey]
 			if !bytes.Equal(re.Data, le.Data) {
-				backupFunc(lKey, le)
+				if err := backupFunc(lKey, le); err != nil {
+					return err
+				}
 			}
 			lhsIndex++
 			rhsIndex++
@@ -800,7 +851,9 @@ func (c *Cpio) Backup(origin string, skip_compress bool) error {
 	for ; lhsIndex < len(lhsKeys); lhsIndex++ {
 		lKey := lhsKeys[lhsIndex]
 		le := lhs[lKey]
-		backupFunc(lKey, le)
+		if err := backupFunc(lKey, le); err != nil {
+			return err
+		}
 	}
 
 	for ; rhsIndex < len(rhsKeys); rhsIndex++ {
@@ -837,18 +890,19 @@ func (c *CpioCli) FromArgs(args []string) {
 	c.Commonds = args[1:]
 }
 
-func parseMode(mode string) uint32 {
-	ret, err := strconv.ParseInt(mode, 8, 32)
+func parseMode(mode string) (uint32, error) {
+	ret, err := strconv.ParseUint(mode, 8, 32)
 	if err != nil {
-		log.Fatalln("Error:", err)
+		return 0, fmt.Errorf("invalid mode %s: %w", mode, err)
 	}
-	return uint32(ret)
+	return uint32(ret), nil
 }
 
-func CpioCommands(argv []string) {
+// Run cpio commands on argv[0], returns the exit code of the last command
+func CpioCommands(argv []string) (int, error) {
 	if len(argv) < 1 {
 		PrintCpioUsage()
-		log.Fatalln("No arguments")
+		return 125, nil
 	}
 
 	cli := NewCpioCli()
@@ -857,91 +911,78 @@ func CpioCommands(argv []string) {
 
 	if _, err := os.Stat(cli.File); err == nil {
 		if err := cpio.LoadFromFile(cli.File); err != nil {
-			log.Fatalf("Load cpio failed: %v", err)
+			return 1, fmt.Errorf("load cpio failed: %w", err)
 		}
 	}
 
-	errExit := func() {
-		PrintCpioUsage()
-		os.Exit(125)
-	}
-
 	for _, command := range cli.Commonds {
 		if strings.HasPrefix(command, "#") {
 			continue
 		}
 		cmd := strings.Split(command, " ")
+		var err error
 		switch cmd[0] {
 		case "test":
-			os.Exit(int(cpio.Test()))
+			return int(cpio.Test()), nil
 		case "restore":
-			cpio.Restore()
+			err = cpio.Restore()
 		case "patch":
-			cpio.Patch()
+			err = cpio.Patch()
 		case "exists":
-			if len(cmd) > 1 {
-				if cpio.Exists(cmd[1]) {
-					os.Exit(0)
-				} else {
-					os.Exit(1)
-				}
-			} else {
-				errExit()
+			if len(cmd) < 2 {
+				PrintCpioUsage()
+				return 125, nil
 			}
+			if cpio.Exists(cmd[1]) {
+				return 0, nil
+			}
+			return 1, nil
 		case "backup":
-			if len(cmd) > 1 {
-				skip_compress := false
-				if len(cmd) > 2 {
-					if cmd[2] == "-n" {
-						skip_compress = true
-					}
-				}
-				if err := cpio.Backup(cmd[1], skip_compress); err != nil {
-					log.Fatalln(err)
-				}
-			} else {
-				errExit()
+			if len(cmd) < 2 {
+				PrintCpioUsage()
+				return 125, nil
 			}
+			skip_compress := len(cmd) > 2 && cmd[2] == "-n"
+			err = cpio.Backup(cmd[1], skip_compress)
 		case "rm":
 			if len(cmd) > 1 {
 				recursive := false
 				path := cmd[1]
-				if cmd[1] == "-r" {
+				if cmd[1] == "-r" && len(cmd) > 2 {
 					recursive = true
 					path = cmd[2]
 				}
-				cpio.Rm(path, recursive)
+				err = cpio.Rm(path, recursive)
 			}
 		case "mv":
-			if len(cmd) > 2 {
-				from := cmd[1]
-				to := cmd[2]
-				cpio.Mv(from, to)
-			} else {
-				errExit()
+			if len(cmd) < 3 {
+				PrintCpioUsage()
+				return 125, nil
 			}
+			err = cpio.Mv(cmd[1], cmd[2])
 		case "ln":
-			if len(cmd) > 2 {
-				src, dst := cmd[1], cmd[2]
-				cpio.Ln(src, dst)
-			} else {
-				errExit()
+			if len(cmd) < 3 {
+				PrintCpioUsage()
+				return 125, nil
 			}
+			err = cpio.Ln(cmd[1], cmd[2])
 		case "mkdir":
-			if len(cmd) > 2 {
-				mode, dir := parseMode(cmd[1]), cmd[2]
-				cpio.Mkdir(mode, dir)
-			} else {
-				errExit()
+			if len(cmd) < 3 {
+				PrintCpioUsage()
+				return 125, nil
+			}
+			var mode uint32
+			if mode, err = parseMode(cmd[1]); err == nil {
+				err = cpio.Mkdir(mode, cmd[2])
 			}
 		case "add":
-			if len(cmd) > 3 {
-				mode, path, file := parseMode(cmd[1]), cmd[2], cmd[3]
-				if err := cpio.Add(mode, path, file); err != nil {
-					log.Fatalln(err)
-				}
-			} else {
-				errExit()
+			if len(cmd) < 4 {
+				PrintCpioUsage()
+				return 125, nil
+			}
+			var mode uint32
+			if mode, err = parseMode(cmd[1]); err == nil {
+				err = cpio.Add(mode, cmd[2], cmd[3])
 			}
 		case "extract":
 			if len(cmd) > 1 {
@@ -949,32 +990,31 @@ func CpioCommands(argv []string) {
 				if len(cmd) > 2 {
 					out = &cmd[2]
 				}
-				if err := cpio.Extract(path, out); err != nil {
-					log.Fatalln(err)
-				}
+				err = cpio.Extract(path, out)
 			}
 		case "ls":
-			if len(cmd) == 1 {
-				cpio.Ls("/", false)
-			} else if len(cmd) == 2 {
-				path := cmd[1]
-				cpio.Ls(path, false)
+			recursive := false
+			path := "/"
+			if len(cmd) == 2 {
+				path = cmd[1]
 			} else if len(cmd) > 2 {
-				recursive := false
-				path := cmd[1]
+				path = cmd[1]
 				if cmd[1] == "-r" {
 					recursive = true
 					path = cmd[2]
 				}
-				cpio.Ls(path, recursive)
-			} else {
-				errExit()
 			}
-			os.Exit(0)
+			if err := cpio.Ls(path, recursive); err != nil {
+				return 1, err
+			}
+			return 0, nil
+		}
+		if err != nil {
+			return 1, err
 		}
 	}
-	err := cpio.Dump(cli.File)
-	if err != nil {
-		log.Fatalln(err)
+	if err := cpio.Dump(cli.File); err != nil {
+		return 1, err
 	}
+	return 0, nil
 }
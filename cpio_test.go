@@ -0,0 +1,50 @@
+package magiskboot_test
+
+import (
+	"magiskboot"
+	"path/filepath"
+	"testing"
+)
+
+func TestCpioEdit(t *testing.T) {
+	t.Log("Test cpio edit commands")
+
+	cpio := magiskboot.NewCpio()
+	if err := cpio.Mkdir(0755, "/system"); err != nil || !cpio.Exists("system") {
+		t.Fatalf("Mkdir failed, Except: %v, But: %v", nil, err)
+	}
+	if err := cpio.Ln("/system/bin", "bin"); err != nil || !cpio.Exists("bin") {
+		t.Fatalf("Ln failed, Except: %v, But: %v", nil, err)
+	}
+	if err := cpio.Rm("missing", false); err != nil {
+		t.Fatalf("Rm missing entry, Except: %v, But: %v", nil, err)
+	}
+	if err := cpio.Rm("/system", true); err != nil || cpio.Exists("system") {
+		t.Fatalf("Rm failed, Except: %v, But: %v", nil, err)
+	}
+
+	t.Log("Test root and empty paths")
+	for _, name := range []string{"", "/", ".", "/system/.."} {
+		if err := cpio.Mkdir(0755, name); err == nil {
+			t.Fatalf("Mkdir %q, Except: error, But: %v", name, err)
+		}
+		if err := cpio.Ln("/system/bin", name); err == nil {
+			t.Fatalf("Ln %q, Except: error, But: %v", name, err)
+		}
+		if err := cpio.Rm(name, true); err == nil {
+			t.Fatalf("Rm %q, Except: error, But: %v", name, err)
+		}
+	}
+	if !cpio.Exists("bin") {
+		t.Fatalf("Rm of the root removed entries")
+	}
+
+	t.Log("Test cpio commands")
+	file := filepath.Join(t.TempDir(), "ramdisk.cpio")
+	if ret, err := magiskboot.CpioCommands([]string{file, "mkdir 0755 /"}); ret != 1 || err == nil {
+		t.Fatalf("mkdir /, Except: %v, But: %v %v", 1, ret, err)
+	}
+	if ret, err := magiskboot.CpioCommands([]string{file, "mkdir 0755 sbin", "ln sbin bin", "rm -r sbin", "patch"}); ret != 0 || err != nil {
+		t.Fatalf("Edit commands, Except: %v, But: %v %v", 0, ret, err)
+	}
+}
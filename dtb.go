@@ -0,0 +1,710 @@
+package magiskboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/edsrzf/mmap-go"
+)
+
+// Tokens of the FDT structure block
+const (
+	FDT_BEGIN_NODE uint32 = 0x1
+	FDT_END_NODE   uint32 = 0x2
+	FDT_PROP       uint32 = 0x3
+	FDT_NOP        uint32 = 0x4
+	FDT_END        uint32 = 0x9
+)
+
+func PrintDtbUsage() {
+	fmt.Fprint(os.Stderr, `Usage: magiskboot dtb <file> <action> [args...]
+Do dtb related actions to <file>.
+
+Supported actions:
+  print [-f]
+    Print all contents of dtb for debugging
+    Specify [-f] to only print fstab nodes
+  patch
+    Search for fstab and remove verity/avb
+    Modifications are done directly to the file in-place
+    Configure with env variables: KEEPVERITY
+  test
+    Test the fstab's status
+    Return values:
+    0:valid    1:error
+  get <path> <prop>
+    Print the value of property <prop> of node <path>
+    Return values:
+    0:found    1:not found
+  set <path> <prop> [value...]
+    Set property <prop> of node <path>, add it if not exists
+    Values are strings, or <cells> and [bytes] like dts
+  delete <path> <prop>
+    Delete property <prop> of node <path>
+    Return values:
+    0:deleted  1:not found
+All appended DTBs in <file> are searched for <path>, e.g.
+/firmware/android/fstab/system, and modified ones are rewritten.
+`)
+}
+
+type fdtHeader struct {
+	Magis           uint32
+	TotalSize       uint32
+	OffDtStruct     uint32
+	OffDtStrings    uint32
+	OffMemRsvmap    uint32
+	Version         uint32
+	LastCompVersion uint32
+	BootCpuidPhys   uint32
+	SizeDtStrings   uint32
+	SizeDtStruct    uint32
+}
+
+type fdtProp struct {
+	Name string
+	// Points into the mapped file, so it can be patched in place
+	Value []byte
+}
+
+type fdtNode struct {
+	Name     string
+	Props    []*fdtProp
+	Children []*fdtNode
+}
+
+// A flattened device tree, Offset is where it starts in the file
+type fdtBlob struct {
+	Offset int
+	Hdr    fdtHeader
+	Root   *fdtNode
+
+	rsvmap []byte
+	strs   []byte
+}
+
+func (n *fdtNode) prop(name string) *fdtProp {
+	for _, p := range n.Props {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// Find all nodes named name in the subtree of n
+func (n *fdtNode) findAll(name string) []*fdtNode {
+	var ret []*fdtNode
+	if n.Name == name {
+		ret = append(ret, n)
+	}
+	for _, c := range n.Children {
+		ret = append(ret, c.findAll(name)...)
+	}
+	return ret
+}
+
+// Parse the FDT at the start of data
+func parseFdt(data []byte) (*fdtBlob, error) {
+	fdt := new(fdtBlob)
+	hdr := &fdt.Hdr
+	if len(data) < binary.Size(hdr) {
+		return nil, truncated("%d bytes is less than fdt header", len(data))
+	}
+	binary.Read(bytes.NewReader(data), binary.BigEndian, hdr)
+	if !bytes.HasPrefix(data, []byte(DTB_MAGIC)) {
+		return nil, badMagic("not a flattened device tree")
+	}
+	if hdr.TotalSize < uint32(binary.Size(hdr)) || uint64(hdr.TotalSize) > uint64(len(data)) {
+		return nil, truncated("fdt total size %d", hdr.TotalSize)
+	}
+	if hdr.Version < 16 {
+		return nil, unsupported("fdt version %d", hdr.Version)
+	}
+	blob := data[:hdr.TotalSize]
+	if hdr.OffDtStruct > hdr.TotalSize ||
+		uint64(hdr.OffDtStrings)+uint64(hdr.SizeDtStrings) > uint64(hdr.TotalSize) {
+		return nil, truncated("fdt blocks exceed total size %d", hdr.TotalSize)
+	}
+	strs := blob[hdr.OffDtStrings : hdr.OffDtStrings+hdr.SizeDtStrings]
+	fdt.strs = strs
+	// The memory reservation map ends with a zero entry
+	for off := uint64(hdr.OffMemRsvmap); ; off += 16 {
+		if off+16 > uint64(len(blob)) {
+			return nil, truncated("fdt memory reservation map")
+		}
+		if !bytes.Equal(blob[off:off+16], make([]byte, 16)) {
+			continue
+		}
+		fdt.rsvmap = blob[hdr.OffMemRsvmap : off+16]
+		break
+	}
+	if hdr.Version >= 17 && uint64(hdr.OffDtStruct)+uint64(hdr.SizeDtStruct) <= uint64(hdr.TotalSize) {
+		blob = blob[:hdr.OffDtStruct+hdr.SizeDtStruct]
+	}
+
+	pos := uint64(hdr.OffDtStruct)
+	next := func() (uint32, bool) {
+		if pos+4 > uint64(len(blob)) {
+			return 0, false
+		}
+		v := binary.BigEndian.Uint32(blob[pos:])
+		pos += 4
+		return v, true
+	}
+
+	var stack []*fdtNode
+	for {
+		tag, ok := next()
+		if !ok {
+			return nil, truncated("fdt structure block")
+		}
+		switch tag {
+		case FDT_BEGIN_NODE:
+			i := bytes.IndexByte(blob[pos:], 0)
+			if i < 0 {
+				return nil, truncated("fdt node name")
+			}
+			node := &fdtNode{Name: string(blob[pos : pos+uint64(i)])}
+			pos = align_4(pos + uint64(i) + 1)
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, node)
+			} else if fdt.Root == nil {
+				fdt.Root = node
+			} else {
+				return nil, badMagic("fdt has more than one root node")
+			}
+			stack = append(stack, node)
+		case FDT_END_NODE:
+			if len(stack) == 0 {
+				return nil, badMagic("fdt node end without begin")
+			}
+			stack = stack[:len(stack)-1]
+		case FDT_PROP:
+			size, ok1 := next()
+			name_off, ok2 := next()
+			if !ok1 || !ok2 || uint64(size) > uint64(len(blob))-pos {
+				return nil, truncated("fdt property")
+			}
+			if len(stack) == 0 {
+				return nil, badMagic("fdt property outside of nodes")
+			}
+			if name_off >= uint32(len(strs)) {
+				return nil, truncated("fdt property name offset 0x%x", name_off)
+			}
+			node := stack[len(stack)-1]
+			node.Props = append(node.Props, &fdtProp{
+				Name:  cstr(strs[name_off:]),
+				Value: blob[pos : pos+uint64(size)],
+			})
+			pos = align_4(pos + uint64(size))
+		case FDT_NOP:
+		case FDT_END:
+			if fdt.Root == nil || len(stack) != 0 {
+				return nil, truncated("fdt structure block ends with unclosed nodes")
+			}
+			return fdt, nil
+		default:
+			return nil, badMagic("unknown fdt token 0x%x", tag)
+		}
+	}
+}
+
+// Find the node at path, a name without unit address matches
+// the first node with that name, e.g. memory matches memory@0
+func (n *fdtNode) lookup(path string) *fdtNode {
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		var next *fdtNode
+		for _, c := range n.Children {
+			if c.Name == name {
+				next = c
+				break
+			}
+		}
+		if next == nil && !strings.Contains(name, "@") {
+			for _, c := range n.Children {
+				if base, _, _ := strings.Cut(c.Name, "@"); base == name {
+					next = c
+					break
+				}
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		n = next
+	}
+	return n
+}
+
+func (n *fdtNode) write(dt_struct *bytes.Buffer, strs *[]byte) {
+	u32 := func(v uint32) {
+		binary.Write(dt_struct, binary.BigEndian, v)
+	}
+	pad := func() {
+		dt_struct.Write(make([]byte, align_4(uint64(dt_struct.Len()))-uint64(dt_struct.Len())))
+	}
+	u32(FDT_BEGIN_NODE)
+	dt_struct.WriteString(n.Name + "\x00")
+	pad()
+	for _, p := range n.Props {
+		// Names could share the tail of another string
+		name_off := bytes.Index(*strs, []byte(p.Name+"\x00"))
+		if name_off < 0 {
+			name_off = len(*strs)
+			*strs = append(*strs, p.Name+"\x00"...)
+		}
+		u32(FDT_PROP)
+		u32(uint32(len(p.Value)))
+		u32(uint32(name_off))
+		dt_struct.Write(p.Value)
+		pad()
+	}
+	for _, c := range n.Children {
+		c.write(dt_struct, strs)
+	}
+	u32(FDT_END_NODE)
+}
+
+// Serialize the FDT as version 17. The memory reservation map and
+// the existing strings are kept, names of new properties are appended.
+func (fdt *fdtBlob) bytes() []byte {
+	dt_struct := new(bytes.Buffer)
+	strs := slices.Clone(fdt.strs)
+	fdt.Root.write(dt_struct, &strs)
+	binary.Write(dt_struct, binary.BigEndian, FDT_END)
+
+	hdr := fdt.Hdr
+	hdr_sz := uint32(binary.Size(hdr))
+	hdr.Version = 17
+	hdr.LastCompVersion = 16
+	hdr.OffMemRsvmap = hdr_sz
+	hdr.OffDtStruct = hdr.OffMemRsvmap + uint32(len(fdt.rsvmap))
+	hdr.SizeDtStruct = uint32(dt_struct.Len())
+	hdr.OffDtStrings = hdr.OffDtStruct + hdr.SizeDtStruct
+	hdr.SizeDtStrings = uint32(len(strs))
+	hdr.TotalSize = hdr.OffDtStrings + hdr.SizeDtStrings
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, &hdr)
+	buf.Write(fdt.rsvmap)
+	buf.Write(dt_struct.Bytes())
+	buf.Write(strs)
+	return buf.Bytes()
+}
+
+// Find all valid FDTs in data
+func findFdts(data []byte) []*fdtBlob {
+	var fdts []*fdtBlob
+	for off := 0; off < len(data); {
+		idx := bytes.Index(data[off:], []byte(DTB_MAGIC))
+		if idx < 0 {
+			break
+		}
+		off += idx
+		fdt, err := parseFdt(data[off:])
+		if err != nil {
+			off += len(DTB_MAGIC)
+			continue
+		}
+		fdt.Offset = off
+		fdts = append(fdts, fdt)
+		off += int(fdt.Hdr.TotalSize)
+	}
+	return fdts
+}
+
+// Offset of the first valid FDT in data, -1 if not found
+func findDtbOffset(data []byte) int {
+	for off := 0; off < len(data); off += len(DTB_MAGIC) {
+		idx := bytes.Index(data[off:], []byte(DTB_MAGIC))
+		if idx < 0 {
+			break
+		}
+		off += idx
+		if _, err := parseFdt(data[off:]); err == nil {
+			return off
+		}
+	}
+	return -1
+}
+
+// A DTB found in a file, e.g. appended to Image.gz-dtb
+type DtbInfo struct {
+	Offset     uint64
+	Size       uint64
+	Model      string
+	Compatible []string
+}
+
+// List all valid DTBs in data
+func FindDtbs(data []byte) []DtbInfo {
+	var dtbs []DtbInfo
+	for _, fdt := range findFdts(data) {
+		dtb := DtbInfo{
+			Offset: uint64(fdt.Offset),
+			Size:   uint64(fdt.Hdr.TotalSize),
+		}
+		if p := fdt.Root.prop("model"); p != nil {
+			dtb.Model = cstr(p.Value)
+		}
+		if p := fdt.Root.prop("compatible"); p != nil && len(p.Value) > 0 {
+			dtb.Compatible = strings.Split(string(bytes.TrimRight(p.Value, "\x00")), "\x00")
+		}
+		dtbs = append(dtbs, dtb)
+	}
+	return dtbs
+}
+
+// Format property value like dtc does: strings, cells or bytes
+func fdtValueString(v []byte) string {
+	// Values patched in place are padded with zeros
+	if s := bytes.TrimRight(v, "\x00"); len(s) > 0 && len(s) < len(v) {
+		printable := true
+		for _, c := range s {
+			if c != 0 && (c < 0x20 || c > 0x7e) {
+				printable = false
+				break
+			}
+		}
+		if printable && !bytes.Contains(s, []byte{0, 0}) && s[0] != 0 {
+			strs := strings.Split(string(s), "\x00")
+			return `"` + strings.Join(strs, `", "`) + `"`
+		}
+	}
+	var sb strings.Builder
+	if len(v)%4 == 0 {
+		sb.WriteByte('<')
+		for i := 0; i < len(v); i += 4 {
+			if i > 0 {
+				sb.WriteByte(' ')
+			}
+			fmt.Fprintf(&sb, "0x%x", binary.BigEndian.Uint32(v[i:]))
+		}
+		sb.WriteByte('>')
+	} else {
+		fmt.Fprintf(&sb, "[% x]", v)
+	}
+	return sb.String()
+}
+
+func (n *fdtNode) print(w io.Writer, depth int) {
+	indent := strings.Repeat("    ", depth)
+	name := n.Name
+	if depth == 0 && name == "" {
+		name = "/"
+	}
+	fmt.Fprintf(w, "%s%s {\n", indent, name)
+	for _, p := range n.Props {
+		if len(p.Value) == 0 {
+			fmt.Fprintf(w, "%s    %s;\n", indent, p.Name)
+		} else {
+			fmt.Fprintf(w, "%s    %s = %s;\n", indent, p.Name, fdtValueString(p.Value))
+		}
+	}
+	for _, c := range n.Children {
+		c.print(w, depth+1)
+	}
+	fmt.Fprintf(w, "%s};\n", indent)
+}
+
+func mapDtbFile(file string, rw bool) (*os.File, mmap.MMap, error) {
+	flag, prot := os.O_RDONLY, mmap.RDONLY
+	if rw {
+		flag, prot = os.O_RDWR, mmap.RDWR
+	}
+	fd, err := os.OpenFile(file, flag, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := mmap.Map(fd, prot, 0)
+	if err != nil {
+		fd.Close()
+		return nil, nil, err
+	}
+	return fd, m, nil
+}
+
+// Print all DTBs in file to stdout, only fstab nodes if fstab is set
+func DtbPrint(file string, fstab bool) error {
+	fd, m, err := mapDtbFile(file, false)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	defer m.Unmap()
+
+	fdts := findFdts(m)
+	if len(fdts) == 0 {
+		return badMagic("cannot find DTB in %s", file)
+	}
+	for i, fdt := range fdts {
+		if !fstab {
+			fmt.Fprintf(os.Stderr, "Printing dtb.%04d\n", i)
+			fdt.Root.print(os.Stdout, 0)
+			continue
+		}
+		for _, node := range fdt.Root.findAll("fstab") {
+			fmt.Fprintf(os.Stderr, "Found fstab in dtb.%04d\n", i)
+			node.print(os.Stdout, 0)
+		}
+	}
+	return nil
+}
+
+// Remove verity flags from the fstab of all DTBs in file, in place.
+// Returns whether anything is patched.
+func DtbPatch(file string) (bool, error) {
+	keep_verity := CheckEnv("KEEPVERITY")
+	fmt.Fprintf(os.Stderr, "Patch with flag KEEPVERITY=[%v]\n", keep_verity)
+	if keep_verity {
+		return false, nil
+	}
+
+	fd, m, err := mapDtbFile(file, true)
+	if err != nil {
+		return false, err
+	}
+	defer fd.Close()
+	defer m.Unmap()
+
+	patched := false
+	for i, fdt := range findFdts(m) {
+		for _, fstab := range fdt.Root.findAll("fstab") {
+			fmt.Fprintf(os.Stderr, "Found fstab in dtb.%04d\n", i)
+			for _, entry := range fstab.Children {
+				flags := entry.prop("fsmgr_flags")
+				if flags == nil {
+					continue
+				}
+				// The new value is never longer, pad it with zeros
+				orig := bytes.TrimRight(flags.Value, "\x00")
+				value := removeFlags(orig, verityPatterns)
+				if len(value) != len(orig) {
+					copy(flags.Value, value)
+					clear(flags.Value[len(value):])
+					patched = true
+				}
+			}
+		}
+	}
+	return patched, m.Flush()
+}
+
+func hasFlags(flags []byte, patterns [][]byte) bool {
+	for _, flag := range bytes.Split(flags, []byte{','}) {
+		for _, pattern := range patterns {
+			if bytes.HasPrefix(flag, pattern) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check the fstab of all DTBs in file.
+// Returns false if /system is still mounted with verity.
+func DtbTest(file string) (bool, error) {
+	fd, m, err := mapDtbFile(file, false)
+	if err != nil {
+		return false, err
+	}
+	defer fd.Close()
+	defer m.Unmap()
+
+	for i, fdt := range findFdts(m) {
+		for _, fstab := range fdt.Root.findAll("fstab") {
+			for _, entry := range fstab.Children {
+				mnt_point := "/" + entry.Name
+				if p := entry.prop("mnt_point"); p != nil {
+					mnt_point = cstr(p.Value)
+				}
+				flags := entry.prop("fsmgr_flags")
+				if mnt_point == "/system" && flags != nil && hasFlags(bytes.TrimRight(flags.Value, "\x00"), verityPatterns) {
+					fmt.Fprintf(os.Stderr, "Found verity on /system in dtb.%04d\n", i)
+					return false, nil
+				}
+			}
+		}
+	}
+	return true, nil
+}
+
+// Parse a property value like dts: <cells>, [bytes], or strings
+func parseFdtValue(args []string) ([]byte, error) {
+	if len(args) == 1 && strings.HasPrefix(args[0], "<") && strings.HasSuffix(args[0], ">") {
+		var value []byte
+		for _, cell := range strings.Fields(args[0][1 : len(args[0])-1]) {
+			v, err := strconv.ParseUint(cell, 0, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cell: %s", cell)
+			}
+			value = binary.BigEndian.AppendUint32(value, uint32(v))
+		}
+		return value, nil
+	}
+	if len(args) == 1 && strings.HasPrefix(args[0], "[") && strings.HasSuffix(args[0], "]") {
+		value, err := hex.DecodeString(strings.Join(strings.Fields(args[0][1:len(args[0])-1]), ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid bytes: %s", args[0])
+		}
+		return value, nil
+	}
+	var value []byte
+	for _, s := range args {
+		value = append(value, s+"\x00"...)
+	}
+	return value, nil
+}
+
+// Call fn on the node at path of all DTBs in file, DTBs that fn
+// returns true for are rewritten. Returns whether any is modified.
+func dtbModify(file, path string, fn func(i int, node *fdtNode) bool) (bool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return false, err
+	}
+	fdts := findFdts(data)
+	if len(fdts) == 0 {
+		return false, badMagic("cannot find DTB in %s", file)
+	}
+
+	out := new(bytes.Buffer)
+	last := 0
+	for i, fdt := range fdts {
+		node := fdt.Root.lookup(path)
+		if node == nil || !fn(i, node) {
+			continue
+		}
+		out.Write(data[last:fdt.Offset])
+		out.Write(fdt.bytes())
+		last = fdt.Offset + int(fdt.Hdr.TotalSize)
+	}
+	if last == 0 {
+		return false, nil
+	}
+	out.Write(data[last:])
+	return true, os.WriteFile(file, out.Bytes(), 0644)
+}
+
+// Print the value of property prop of node path in all DTBs of file.
+// Returns whether it is found.
+func DtbGet(file, path, prop string) (bool, error) {
+	fd, m, err := mapDtbFile(file, false)
+	if err != nil {
+		return false, err
+	}
+	defer fd.Close()
+	defer m.Unmap()
+
+	fdts := findFdts(m)
+	if len(fdts) == 0 {
+		return false, badMagic("cannot find DTB in %s", file)
+	}
+	found := false
+	for i, fdt := range fdts {
+		node := fdt.Root.lookup(path)
+		if node == nil {
+			continue
+		}
+		if p := node.prop(prop); p != nil {
+			fmt.Fprintf(os.Stderr, "Found %s in dtb.%04d\n", prop, i)
+			fmt.Println(fdtValueString(p.Value))
+			found = true
+		}
+	}
+	return found, nil
+}
+
+// Set property prop of node path in all DTBs of file, add it if not exists
+func DtbSet(file, path, prop string, value []byte) error {
+	modified, err := dtbModify(file, path, func(i int, node *fdtNode) bool {
+		fmt.Fprintf(os.Stderr, "Set %s in dtb.%04d\n", prop, i)
+		if p := node.prop(prop); p != nil {
+			p.Value = value
+		} else {
+			node.Props = append(node.Props, &fdtProp{Name: prop, Value: value})
+		}
+		return true
+	})
+	if err == nil && !modified {
+		err = fmt.Errorf("cannot find node %s in %s", path, file)
+	}
+	return err
+}
+
+// Delete property prop of node path in all DTBs of file.
+// Returns whether anything is deleted.
+func DtbDelete(file, path, prop string) (bool, error) {
+	return dtbModify(file, path, func(i int, node *fdtNode) bool {
+		idx := slices.IndexFunc(node.Props, func(p *fdtProp) bool { return p.Name == prop })
+		if idx < 0 {
+			return false
+		}
+		fmt.Fprintf(os.Stderr, "Delete %s in dtb.%04d\n", prop, i)
+		node.Props = slices.Delete(node.Props, idx, idx+1)
+		return true
+	})
+}
+
+// Run dtb action argv[1] on argv[0], returns the exit code
+func DtbCommands(argv []string) (int, error) {
+	if len(argv) < 2 {
+		PrintDtbUsage()
+		return 125, nil
+	}
+	file, action := argv[0], argv[1]
+	switch action {
+	case "print":
+		fstab := len(argv) > 2 && argv[2] == "-f"
+		return 0, DtbPrint(file, fstab)
+	case "patch":
+		patched, err := DtbPatch(file)
+		if err != nil || !patched {
+			return 1, err
+		}
+	case "test":
+		ok, err := DtbTest(file)
+		if err != nil || !ok {
+			return 1, err
+		}
+	case "get", "delete":
+		if len(argv) != 4 {
+			PrintDtbUsage()
+			return 125, nil
+		}
+		op := DtbGet
+		if action == "delete" {
+			op = DtbDelete
+		}
+		ok, err := op(file, argv[2], argv[3])
+		if err != nil || !ok {
+			return 1, err
+		}
+	case "set":
+		if len(argv) < 4 {
+			PrintDtbUsage()
+			return 125, nil
+		}
+		value, err := parseFdtValue(argv[4:])
+		if err != nil {
+			return 1, err
+		}
+		return 0, DtbSet(file, argv[2], argv[3], value)
+	default:
+		PrintDtbUsage()
+		return 125, nil
+	}
+	return 0, nil
+}
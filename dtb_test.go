@@ -0,0 +1,319 @@
+package magiskboot_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"magiskboot"
+	"os"
+	"reflect"
+	"testing"
+)
+
+type testFdtNode struct {
+	name     string
+	props    [][2]string
+	children []testFdtNode
+}
+
+// Build a v17 FDT, property values are written as strings
+func makeFdt(t *testing.T, root testFdtNode) []byte {
+	dt_struct := new(bytes.Buffer)
+	dt_strings := new(bytes.Buffer)
+	u32 := func(v uint32) {
+		binary.Write(dt_struct, binary.BigEndian, v)
+	}
+	pad := func() {
+		dt_struct.Write(make([]byte, (4-dt_struct.Len()%4)%4))
+	}
+	var write func(n testFdtNode)
+	write = func(n testFdtNode) {
+		u32(0x1)
+		dt_struct.WriteString(n.name + "\x00")
+		pad()
+		for _, p := range n.props {
+			u32(0x3)
+			u32(uint32(len(p[1]) + 1))
+			u32(uint32(dt_strings.Len()))
+			dt_strings.WriteString(p[0] + "\x00")
+			dt_struct.WriteString(p[1] + "\x00")
+			pad()
+		}
+		for _, c := range n.children {
+			write(c)
+		}
+		u32(0x2)
+	}
+	write(root)
+	u32(0x9)
+
+	const hdr_sz = 40
+	const rsvmap_sz = 16
+	buf := new(bytes.Buffer)
+	for _, v := range []uint32{
+		0xd00dfeed,
+		uint32(hdr_sz + rsvmap_sz + dt_struct.Len() + dt_strings.Len()),
+		hdr_sz + rsvmap_sz,
+		uint32(hdr_sz + rsvmap_sz + dt_struct.Len()),
+		hdr_sz,
+		17,
+		16,
+		0,
+		uint32(dt_strings.Len()),
+		uint32(dt_struct.Len()),
+	} {
+		if err := binary.Write(buf, binary.BigEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf.Write(make([]byte, rsvmap_sz))
+	buf.Write(dt_struct.Bytes())
+	buf.Write(dt_strings.Bytes())
+	return buf.Bytes()
+}
+
+func makeFstabDtb(t *testing.T, system_flags string) []byte {
+	return makeFdt(t, testFdtNode{
+		props: [][2]string{{"model", "Test Device"}},
+		children: []testFdtNode{{
+			name: "firmware",
+			children: []testFdtNode{{
+				name:  "android",
+				props: [][2]string{{"compatible", "android,firmware"}},
+				children: []testFdtNode{{
+					name: "fstab",
+					children: []testFdtNode{
+						{name: "system", props: [][2]string{
+							{"compatible", "android,system"},
+							{"type", "ext4"},
+							{"fsmgr_flags", system_flags},
+						}},
+						{name: "vendor", props: [][2]string{
+							{"compatible", "android,vendor"},
+							{"fsmgr_flags", "wait,verify"},
+						}},
+					},
+				}},
+			}},
+		}},
+	})
+}
+
+func TestDtb(t *testing.T) {
+	t.Log("Test dtb print, patch and test")
+	t.Chdir(t.TempDir())
+	t.Setenv("KEEPVERITY", "false")
+
+	// Two DTBs appended to some kernel data
+	dtb := append(bytes.Repeat([]byte("KERNEL"), 100), makeFstabDtb(t, "wait,slotselect,avb=vbmeta,first_stage_mount")...)
+	dtb = append(dtb, makeFstabDtb(t, "wait")...)
+	if err := os.WriteFile("kernel_dtb", dtb, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := magiskboot.DtbPrint("kernel_dtb", true); err != nil {
+		t.Fatalf("Print failed, Except: %v, But: %v", nil, err)
+	}
+	if ok, err := magiskboot.DtbTest("kernel_dtb"); ok || err != nil {
+		t.Fatalf("Test before patch, Except: %v, But: %v", false, []any{ok, err})
+	}
+
+	if patched, err := magiskboot.DtbPatch("kernel_dtb"); !patched || err != nil {
+		t.Fatalf("Patch failed, Except: %v, But: %v", true, []any{patched, err})
+	}
+	if ok, err := magiskboot.DtbTest("kernel_dtb"); !ok || err != nil {
+		t.Fatalf("Test after patch, Except: %v, But: %v", true, []any{ok, err})
+	}
+
+	data, err := os.ReadFile("kernel_dtb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != len(dtb) {
+		t.Fatalf("File size changed, Except: %v, But: %v", len(dtb), len(data))
+	}
+	for _, expect := range []string{
+		"wait,slotselect,first_stage_mount\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+		"wait\x00\x00\x00\x00\x00\x00\x00",
+	} {
+		if !bytes.Contains(data, []byte(expect)) {
+			t.Fatalf("Patched flags not found, Except: %q", expect)
+		}
+	}
+	if bytes.Contains(data, []byte("verify")) || bytes.Contains(data, []byte("avb")) {
+		t.Fatalf("Verity flags not removed, But: %q", data)
+	}
+
+	// Nothing left to patch
+	if patched, err := magiskboot.DtbPatch("kernel_dtb"); patched || err != nil {
+		t.Fatalf("Patch again, Except: %v, But: %v", false, []any{patched, err})
+	}
+
+	if err := os.WriteFile("empty", []byte("no dtb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := magiskboot.DtbPrint("empty", false); !errors.Is(err, magiskboot.ErrBadMagic) {
+		t.Fatalf("Print without dtb, Except: %v, But: %v", magiskboot.ErrBadMagic, err)
+	}
+
+	// Corrupted structure blocks are skipped, the first token is FDT_BEGIN_NODE
+	for _, tag := range []uint32{0x2, 0x7} {
+		bad := makeFstabDtb(t, "wait")
+		binary.BigEndian.PutUint32(bad[56:], tag)
+		if dtbs := magiskboot.FindDtbs(bad); len(dtbs) != 0 {
+			t.Fatalf("Find corrupted dtb, Except: %v, But: %v", nil, dtbs)
+		}
+	}
+}
+
+func TestSplitImageDtb(t *testing.T) {
+	t.Log("Test split all appended dtbs")
+	t.Chdir(t.TempDir())
+
+	dtbs := [][]byte{
+		makeFdt(t, testFdtNode{props: [][2]string{{"model", "Board A"}, {"compatible", "vendor,a\x00vendor,soc"}}}),
+		makeFdt(t, testFdtNode{props: [][2]string{{"model", "Board B"}, {"compatible", "vendor,b"}}}),
+	}
+	kernel := gzipData(t, testKernel)
+	img := bytes.Join([][]byte{kernel, dtbs[0], dtbs[1]}, nil)
+	if err := os.WriteFile("Image.gz-dtb", img, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []magiskboot.DtbInfo{
+		{Offset: uint64(len(kernel)), Size: uint64(len(dtbs[0])), Model: "Board A", Compatible: []string{"vendor,a", "vendor,soc"}},
+		{Offset: uint64(len(kernel) + len(dtbs[0])), Size: uint64(len(dtbs[1])), Model: "Board B", Compatible: []string{"vendor,b"}},
+	}
+	if ret := magiskboot.FindDtbs(img); !reflect.DeepEqual(ret, expect) {
+		t.Fatalf("Dtbs mismatch\nExcept: %v\nBut: %v", expect, ret)
+	}
+
+	if err := magiskboot.SplitImageDtb("Image.gz-dtb", false, true); err != nil {
+		t.Fatalf("Split failed, Except: %v, But: %v", nil, err)
+	}
+	checkFiles(t, map[string][]byte{
+		magiskboot.KERNEL_FILE:         testKernel,
+		magiskboot.KER_DTB_FILE:        bytes.Join(dtbs, nil),
+		magiskboot.KER_DTB_FILE + ".0": dtbs[0],
+		magiskboot.KER_DTB_FILE + ".1": dtbs[1],
+	})
+}
+
+func TestMergeImageDtb(t *testing.T) {
+	t.Log("Test merge kernel and dtbs back into lz4_lg image")
+	t.Chdir(t.TempDir())
+
+	if err := os.WriteFile("Image", testKernel, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := magiskboot.Compress("lz4_lg", "Image", "Image.lz4"); err != nil {
+		t.Fatal(err)
+	}
+	kernel, err := os.ReadFile("Image.lz4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dtbs := [][]byte{
+		makeFdt(t, testFdtNode{props: [][2]string{{"model", "Board A"}}}),
+		makeFdt(t, testFdtNode{props: [][2]string{{"model", "Board B"}}}),
+	}
+	orig := bytes.Join([][]byte{kernel, dtbs[0], dtbs[1]}, nil)
+	if err := os.WriteFile("Image.lz4-dtb", orig, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := magiskboot.SplitImageDtb("Image.lz4-dtb", false, true); err != nil {
+		t.Fatalf("Split failed, Except: %v, But: %v", nil, err)
+	}
+	checkFiles(t, map[string][]byte{magiskboot.KERNEL_FILE: testKernel})
+
+	// Recompressed with the size trailer, the result should be identical
+	if err := magiskboot.MergeImageDtb("Image.lz4-dtb", "new-Image.lz4-dtb", false); err != nil {
+		t.Fatalf("Merge failed, Except: %v, But: %v", nil, err)
+	}
+	checkFiles(t, map[string][]byte{"new-Image.lz4-dtb": orig})
+
+	// Join kernel_dtb.N when kernel_dtb is missing
+	dtbs[1] = makeFdt(t, testFdtNode{props: [][2]string{{"model", "Board C"}}})
+	os.Remove(magiskboot.KER_DTB_FILE)
+	os.WriteFile(magiskboot.KER_DTB_FILE+".1", dtbs[1], 0644)
+	if err := magiskboot.MergeImageDtb("Image.lz4-dtb", "new-Image.lz4-dtb", false); err != nil {
+		t.Fatalf("Merge failed, Except: %v, But: %v", nil, err)
+	}
+	checkFiles(t, map[string][]byte{"new-Image.lz4-dtb": bytes.Join([][]byte{kernel, dtbs[0], dtbs[1]}, nil)})
+}
+
+func TestDtbProps(t *testing.T) {
+	t.Log("Test dtb get, set and delete property")
+	t.Chdir(t.TempDir())
+
+	kernel := bytes.Repeat([]byte("KERNEL"), 100)
+	other := makeFdt(t, testFdtNode{props: [][2]string{{"model", "No fstab"}}})
+	dtb := bytes.Join([][]byte{kernel, makeFstabDtb(t, "wait,slotselect,avb"), other}, nil)
+	if err := os.WriteFile("kernel_dtb", dtb, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dtb_cmd := func(args ...string) int {
+		ret, err := magiskboot.DtbCommands(append([]string{"kernel_dtb"}, args...))
+		if err != nil {
+			t.Fatalf("Dtb %v failed, Except: %v, But: %v", args, nil, err)
+		}
+		return ret
+	}
+
+	path := "/firmware/android/fstab/system"
+	if ret := dtb_cmd("get", path, "fsmgr_flags"); ret != 0 {
+		t.Fatalf("Get, Except: %v, But: %v", 0, ret)
+	}
+	if ret := dtb_cmd("get", path, "mnt_point"); ret != 1 {
+		t.Fatalf("Get missing, Except: %v, But: %v", 1, ret)
+	}
+
+	// Rewritten with the value resized, other DTBs are untouched
+	dtb_cmd("set", path, "fsmgr_flags", "wait")
+	data, err := os.ReadFile("kernel_dtb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := uint64(len(makeFstabDtb(t, "wait")))
+	expect := []magiskboot.DtbInfo{
+		{Offset: uint64(len(kernel)), Size: size, Model: "Test Device"},
+		{Offset: uint64(len(kernel)) + size, Size: uint64(len(other)), Model: "No fstab"},
+	}
+	if ret := magiskboot.FindDtbs(data); !reflect.DeepEqual(ret, expect) || !bytes.HasSuffix(data, other) {
+		t.Fatalf("Dtbs mismatch\nExcept: %v\nBut: %v", expect, ret)
+	}
+	if !bytes.Contains(data, []byte("wait\x00")) || bytes.Contains(data, []byte("slotselect")) {
+		t.Fatalf("Value not set, But: %q", data)
+	}
+
+	dtb_cmd("set", "/", "cells", "<0x1 2>")
+	dtb_cmd("set", "/firmware/android", "names", "a", "b")
+	dtb_cmd("set", "/firmware/android", "raw", "[de ad]")
+	data, err = os.ReadFile("kernel_dtb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{"\x00\x00\x00\x01\x00\x00\x00\x02", "a\x00b\x00", "\xde\xad", "cells\x00names\x00raw\x00"} {
+		if !bytes.Contains(data, []byte(expect)) {
+			t.Fatalf("New property not found, Except: %q", expect)
+		}
+	}
+	if dtbs := magiskboot.FindDtbs(data); len(dtbs) != 2 || dtbs[0].Offset != uint64(len(kernel)) || dtbs[1].Model != "No fstab" {
+		t.Fatalf("Dtbs mismatch, Except: %v, But: %v", 2, dtbs)
+	}
+
+	if ret := dtb_cmd("delete", path, "fsmgr_flags"); ret != 0 {
+		t.Fatalf("Delete, Except: %v, But: %v", 0, ret)
+	}
+	if ret := dtb_cmd("delete", path, "fsmgr_flags"); ret != 1 {
+		t.Fatalf("Delete again, Except: %v, But: %v", 1, ret)
+	}
+	if ret := dtb_cmd("get", path, "fsmgr_flags"); ret != 1 {
+		t.Fatalf("Get deleted, Except: %v, But: %v", 1, ret)
+	}
+
+	if _, err := magiskboot.DtbCommands([]string{"kernel_dtb", "set", "/missing", "prop", "x"}); err == nil {
+		t.Fatalf("Set missing node, Except: error, But: %v", err)
+	}
+}
@@ -0,0 +1,299 @@
+package magiskboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const DTBO_PAGE_SIZE = 2048
+
+func PrintDtboUsage() {
+	fmt.Fprint(os.Stderr, `Usage: magiskboot dtbo <file> <action> [args...]
+Do actions to the DT table image <file>, e.g. dtbo.img or recovery_dtbo.
+
+Supported actions:
+  list
+    List the table header and all entries
+  extract [dir]
+    Extract each overlay to [dir]/dtbo.N, and the entries to
+    [dir]/dtbo_table. [dir] defaults to 'dtbo'
+  rebuild [dir]
+    Rebuild <file> from the overlays and dtbo_table in [dir].
+    Without dtbo_table, dtbo.N are added in order with zero id and rev
+`)
+}
+
+// dt_table_header of a DT table image, all fields are big endian
+type DtTableHeader struct {
+	Magic           uint32
+	TotalSize       uint32 // includes the header, all entries and overlays
+	HeaderSize      uint32
+	DtEntrySize     uint32
+	DtEntryCount    uint32
+	DtEntriesOffset uint32
+	PageSize        uint32
+	Version         uint32
+}
+
+// dt_table_entry of a DT table image.
+// On version 1 tables, the low bits of Custom[0] are the compression flags.
+type DtTableEntry struct {
+	DtSize   uint32
+	DtOffset uint32
+	Id       uint32
+	Rev      uint32
+	Custom   [4]uint32
+}
+
+type Dtbo struct {
+	Hdr     DtTableHeader
+	Entries []DtTableEntry
+	// Overlay of each entry, entries may share the same overlay
+	Overlays [][]byte
+}
+
+// Parse the DT table at the start of data, overlays are sliced from data
+func ParseDtbo(data []byte) (*Dtbo, error) {
+	d := new(Dtbo)
+	hdr := &d.Hdr
+	hdr_sz := binary.Size(hdr)
+	entry_sz := binary.Size(DtTableEntry{})
+	if len(data) < hdr_sz {
+		return nil, truncated("%d bytes is less than dt table header", len(data))
+	}
+	if !bytes.HasPrefix(data, []byte(DTBO_MAGIC)) {
+		return nil, badMagic("not a dt table image")
+	}
+	binary.Read(bytes.NewReader(data), binary.BigEndian, hdr)
+	if hdr.HeaderSize < uint32(hdr_sz) || hdr.DtEntrySize < uint32(entry_sz) {
+		return nil, unsupported("dt table header size %d, entry size %d", hdr.HeaderSize, hdr.DtEntrySize)
+	}
+	if uint64(hdr.TotalSize) > uint64(len(data)) {
+		return nil, truncated("dt table total size %d", hdr.TotalSize)
+	}
+	data = data[:hdr.TotalSize]
+	if uint64(hdr.DtEntriesOffset)+uint64(hdr.DtEntryCount)*uint64(hdr.DtEntrySize) > uint64(len(data)) {
+		return nil, truncated("%d dt table entries", hdr.DtEntryCount)
+	}
+
+	for i := uint32(0); i < hdr.DtEntryCount; i++ {
+		off := hdr.DtEntriesOffset + i*hdr.DtEntrySize
+		var e DtTableEntry
+		binary.Read(bytes.NewReader(data[off:]), binary.BigEndian, &e)
+		if uint64(e.DtOffset)+uint64(e.DtSize) > uint64(len(data)) {
+			return nil, truncated("dtbo.%d offset 0x%x size %d", i, e.DtOffset, e.DtSize)
+		}
+		d.Entries = append(d.Entries, e)
+		d.Overlays = append(d.Overlays, data[e.DtOffset:e.DtOffset+e.DtSize])
+	}
+	return d, nil
+}
+
+// Serialize the table, overlays are laid out right after the entries.
+// Identical overlays are stored once and share the offset, like mkdtboimg does.
+func (d *Dtbo) Bytes() []byte {
+	hdr := d.Hdr
+	hdr.Magic = binary.BigEndian.Uint32([]byte(DTBO_MAGIC))
+	hdr.HeaderSize = uint32(binary.Size(hdr))
+	hdr.DtEntrySize = uint32(binary.Size(DtTableEntry{}))
+	hdr.DtEntryCount = uint32(len(d.Entries))
+	hdr.DtEntriesOffset = hdr.HeaderSize
+	if hdr.PageSize == 0 {
+		hdr.PageSize = DTBO_PAGE_SIZE
+	}
+
+	off := hdr.DtEntriesOffset + hdr.DtEntryCount*hdr.DtEntrySize
+	entries := slices.Clone(d.Entries)
+	blobs := new(bytes.Buffer)
+	for i, dt := range d.Overlays[:len(entries)] {
+		e := &entries[i]
+		e.DtSize = uint32(len(dt))
+		if j := slices.IndexFunc(d.Overlays[:i], func(b []byte) bool { return bytes.Equal(b, dt) }); j >= 0 {
+			e.DtOffset = entries[j].DtOffset
+			continue
+		}
+		e.DtOffset = off + uint32(blobs.Len())
+		blobs.Write(dt)
+	}
+	hdr.TotalSize = off + uint32(blobs.Len())
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, &hdr)
+	binary.Write(buf, binary.BigEndian, entries)
+	buf.Write(blobs.Bytes())
+	return buf.Bytes()
+}
+
+func (d *Dtbo) Print(w io.Writer) {
+	fmt.Fprintf(w, "%-*s [%d]\n", PADDING, "DTBO_VER", d.Hdr.Version)
+	fmt.Fprintf(w, "%-*s [%d]\n", PADDING, "PAGESIZE", d.Hdr.PageSize)
+	fmt.Fprintf(w, "%-*s [%d]\n", PADDING, "TOTAL_SZ", d.Hdr.TotalSize)
+	fmt.Fprintf(w, "%-*s [%d]\n", PADDING, "ENTRY_COUNT", len(d.Entries))
+	for i, e := range d.Entries {
+		fmt.Fprintf(w, "%-*s offset=[0x%x] size=[%d] id=[0x%08x] rev=[0x%08x] custom=[%s]\n",
+			PADDING, fmt.Sprintf("dtbo.%d", i), e.DtOffset, e.DtSize, e.Id, e.Rev, dtboCustomString(e.Custom))
+	}
+}
+
+func dtboCustomString(custom [4]uint32) string {
+	strs := make([]string, len(custom))
+	for i, c := range custom {
+		strs[i] = fmt.Sprintf("0x%08x", c)
+	}
+	return strings.Join(strs, ",")
+}
+
+// Write each overlay to dir/dtbo.N, and the entries to dir/dtbo_table,
+// so the table could be rebuilt with LoadDtbo
+func (d *Dtbo) Extract(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tbl := new(strings.Builder)
+	fmt.Fprintf(tbl, "page_size=%d version=%d\n", d.Hdr.PageSize, d.Hdr.Version)
+	for i, e := range d.Entries {
+		file := fmt.Sprintf("dtbo.%d", i)
+		if err := os.WriteFile(filepath.Join(dir, file), d.Overlays[i], 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(tbl, "file=%s id=0x%08x rev=0x%08x custom=%s\n", file, e.Id, e.Rev, dtboCustomString(e.Custom))
+	}
+	return os.WriteFile(filepath.Join(dir, DTBO_TBL), []byte(tbl.String()), 0644)
+}
+
+func parseDtboField(key, value string) (uint32, error) {
+	v, err := strconv.ParseUint(value, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid dtbo %s: %s", key, value)
+	}
+	return uint32(v), nil
+}
+
+// Load a table written by Extract from dir.
+// Without dtbo_table, dtbo.N are loaded in order with zero id and rev.
+func LoadDtbo(dir string) (*Dtbo, error) {
+	d := new(Dtbo)
+	d.Hdr.PageSize = DTBO_PAGE_SIZE
+
+	data, err := os.ReadFile(filepath.Join(dir, DTBO_TBL))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		for i := 0; ; i++ {
+			dt, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("dtbo.%d", i)))
+			if os.IsNotExist(err) {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			d.Entries = append(d.Entries, DtTableEntry{})
+			d.Overlays = append(d.Overlays, dt)
+		}
+		if len(d.Entries) == 0 {
+			return nil, fmt.Errorf("cannot find dtbo.0 or %s in %s", DTBO_TBL, dir)
+		}
+		return d, nil
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		e := DtTableEntry{}
+		file := ""
+		for _, field := range strings.Fields(line) {
+			key, value, _ := strings.Cut(field, "=")
+			var err error
+			switch key {
+			case "page_size":
+				d.Hdr.PageSize, err = parseDtboField(key, value)
+			case "version":
+				d.Hdr.Version, err = parseDtboField(key, value)
+			case "file":
+				file = value
+			case "id":
+				e.Id, err = parseDtboField(key, value)
+			case "rev":
+				e.Rev, err = parseDtboField(key, value)
+			case "custom":
+				for i, c := range strings.Split(value, ",") {
+					if i >= len(e.Custom) {
+						break
+					}
+					if e.Custom[i], err = parseDtboField(key, c); err != nil {
+						break
+					}
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if file == "" {
+			continue
+		}
+		dt, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return nil, err
+		}
+		d.Entries = append(d.Entries, e)
+		d.Overlays = append(d.Overlays, dt)
+	}
+	return d, nil
+}
+
+// Run dtbo action argv[1] on argv[0], returns the exit code
+func DtboCommands(argv []string) (int, error) {
+	if len(argv) < 2 {
+		PrintDtboUsage()
+		return 125, nil
+	}
+	file, action := argv[0], argv[1]
+	dir := DTBO_DIR
+	if len(argv) > 2 {
+		dir = argv[2]
+	}
+
+	switch action {
+	case "list", "extract":
+		fd, m, err := mapDtbFile(file, false)
+		if err != nil {
+			return 1, err
+		}
+		defer fd.Close()
+		defer m.Unmap()
+
+		d, err := ParseDtbo(m)
+		if err != nil {
+			return 1, err
+		}
+		if action == "list" {
+			d.Print(os.Stdout)
+			return 0, nil
+		}
+		d.Print(os.Stderr)
+		return 0, d.Extract(dir)
+	case "rebuild":
+		d, err := LoadDtbo(dir)
+		if err != nil {
+			return 1, err
+		}
+		data := d.Bytes()
+		if d, err = ParseDtbo(data); err != nil {
+			return 1, err
+		}
+		d.Print(os.Stderr)
+		return 0, os.WriteFile(file, data, 0644)
+	default:
+		PrintDtboUsage()
+		return 125, nil
+	}
+}
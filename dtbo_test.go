@@ -0,0 +1,111 @@
+package magiskboot_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"magiskboot"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Build a DT table like mkdtboimg, entries with the same overlay share it
+func makeDtbo(t *testing.T, overlays [][]byte, entries []magiskboot.DtTableEntry) []byte {
+	const hdr_sz, entry_sz = 32, 32
+	off := uint32(hdr_sz + entry_sz*len(entries))
+	blobs := new(bytes.Buffer)
+	offsets := make([]uint32, len(overlays))
+	for i, dt := range overlays {
+		offsets[i] = off + uint32(blobs.Len())
+		blobs.Write(dt)
+	}
+	buf := new(bytes.Buffer)
+	hdr := magiskboot.DtTableHeader{
+		Magic:           0xd7b7ab1e,
+		TotalSize:       off + uint32(blobs.Len()),
+		HeaderSize:      hdr_sz,
+		DtEntrySize:     entry_sz,
+		DtEntryCount:    uint32(len(entries)),
+		DtEntriesOffset: hdr_sz,
+		PageSize:        4096,
+	}
+	if err := binary.Write(buf, binary.BigEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		// DtOffset holds the overlay index here
+		e.DtSize = uint32(len(overlays[e.DtOffset]))
+		e.DtOffset = offsets[e.DtOffset]
+		if err := binary.Write(buf, binary.BigEndian, &e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf.Write(blobs.Bytes())
+	return buf.Bytes()
+}
+
+func TestDtbo(t *testing.T) {
+	t.Log("Test dtbo list, extract and rebuild")
+	t.Chdir(t.TempDir())
+
+	overlays := [][]byte{
+		makeFdt(t, testFdtNode{props: [][2]string{{"model", "Overlay A"}}}),
+		makeFdt(t, testFdtNode{props: [][2]string{{"model", "Overlay B"}}}),
+	}
+	img := makeDtbo(t, overlays, []magiskboot.DtTableEntry{
+		{DtOffset: 0, Id: 0x10, Rev: 1, Custom: [4]uint32{0xa, 0, 0, 0xd}},
+		{DtOffset: 1, Id: 0x20, Rev: 2},
+		{DtOffset: 0, Id: 0x30, Rev: 3},
+	})
+	// Partitions are padded after the table
+	if err := os.WriteFile("dtbo.img", append(img, make([]byte, 4096)...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := magiskboot.ParseDtbo(img)
+	if err != nil {
+		t.Fatalf("Parse failed, Except: %v, But: %v", nil, err)
+	}
+	if len(d.Entries) != 3 || d.Entries[2].DtOffset != d.Entries[0].DtOffset || d.Hdr.PageSize != 4096 {
+		t.Fatalf("Table mismatch, Except: %v, But: %+v", "3 entries sharing overlay 0", d)
+	}
+	if !reflect.DeepEqual(d.Overlays, [][]byte{overlays[0], overlays[1], overlays[0]}) {
+		t.Fatalf("Overlays mismatch\nExcept: %v\nBut: %v", overlays, d.Overlays)
+	}
+	if ret := d.Bytes(); !bytes.Equal(ret, img) {
+		t.Fatalf("Serialize mismatch\nExcept: %v\nBut: %v", img, ret)
+	}
+
+	if _, err := magiskboot.DtboCommands([]string{"dtbo.img", "extract", "out"}); err != nil {
+		t.Fatalf("Extract failed, Except: %v, But: %v", nil, err)
+	}
+	checkFiles(t, map[string][]byte{
+		filepath.Join("out", "dtbo.0"): overlays[0],
+		filepath.Join("out", "dtbo.1"): overlays[1],
+		filepath.Join("out", "dtbo.2"): overlays[0],
+	})
+
+	if _, err := magiskboot.DtboCommands([]string{"new-dtbo.img", "rebuild", "out"}); err != nil {
+		t.Fatalf("Rebuild failed, Except: %v, But: %v", nil, err)
+	}
+	checkFiles(t, map[string][]byte{"new-dtbo.img": img})
+
+	// Without the table, overlays are added in order
+	os.Remove(filepath.Join("out", magiskboot.DTBO_TBL))
+	d, err = magiskboot.LoadDtbo("out")
+	if err != nil {
+		t.Fatalf("Load failed, Except: %v, But: %v", nil, err)
+	}
+	if len(d.Entries) != 3 || d.Entries[0].Id != 0 || d.Hdr.PageSize != magiskboot.DTBO_PAGE_SIZE {
+		t.Fatalf("Load without table mismatch, Except: %v, But: %+v", "3 entries with zero id", d)
+	}
+
+	if _, err := magiskboot.ParseDtbo(overlays[0]); !errors.Is(err, magiskboot.ErrBadMagic) {
+		t.Fatalf("Parse dtb, Except: %v, But: %v", magiskboot.ErrBadMagic, err)
+	}
+	if _, err := magiskboot.ParseDtbo(img[:len(img)-1]); !errors.Is(err, magiskboot.ErrTruncated) {
+		t.Fatalf("Parse truncated, Except: %v, But: %v", magiskboot.ErrTruncated, err)
+	}
+}
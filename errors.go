@@ -0,0 +1,29 @@
+package magiskboot
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the library are wrapped around one of these,
+// test them with errors.Is
+var (
+	// Data does not start with the expected magic
+	ErrBadMagic = errors.New("bad magic")
+	// Data is shorter than what its headers describe
+	ErrTruncated = errors.New("truncated data")
+	// Format, algorithm or entry type is recognized but not supported
+	ErrUnsupported = errors.New("unsupported format")
+)
+
+func badMagic(format string, a ...any) error {
+	return fmt.Errorf("%w: %s", ErrBadMagic, fmt.Sprintf(format, a...))
+}
+
+func truncated(format string, a ...any) error {
+	return fmt.Errorf("%w: %s", ErrTruncated, fmt.Sprintf(format, a...))
+}
+
+func unsupported(format string, a ...any) error {
+	return fmt.Errorf("%w: %s", ErrUnsupported, fmt.Sprintf(format, a...))
+}
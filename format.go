@@ -25,6 +25,7 @@ const (
 	MTK
 	DTB
 	ZIMAGE
+	DTBO
 )
 
 type format_t int
@@ -51,6 +52,7 @@ const (
 	LZ42_MAGIC               = "\x04\x22\x4d\x18"
 	MTK_MAGIC                = "\x88\x16\x88\x58"
 	DTB_MAGIC                = "\xd0\x0d\xfe\xed"
+	DTBO_MAGIC               = "\xd7\xb7\xab\x1e"
 	LG_BUMP_MAGIC            = "\x41\xa9\xe4\x67\x74\x4d\x1d\x1b\xa4\x29\xf2\xec\xea\x65\x52\x79"
 	DHTB_MAGIC               = "\x44\x48\x54\x42\x01\x00\x00\x00"
 	SEANDROID_MAGIC          = "SEANDROIDENFORCE"
@@ -72,7 +74,7 @@ const (
 
 func CheckFmt(buf []byte) format_t {
 	CHECKED_MATCH := func(p string) bool {
-		return bytes.Equal([]byte(p), buf[:len(p)])
+		return bytes.HasPrefix(buf, []byte(p))
 	}
 
 	if CHECKED_MATCH(CHROMEOS_MAGIC) {
@@ -99,6 +101,8 @@ func CheckFmt(buf []byte) format_t {
 		return MTK
 	} else if CHECKED_MATCH(DTB_MAGIC) {
 		return DTB
+	} else if CHECKED_MATCH(DTBO_MAGIC) {
+		return DTBO
 	} else if CHECKED_MATCH(DHTB_MAGIC) {
 		return DHTB
 	} else if CHECKED_MATCH(TEGRABLOB_MAGIC) {
@@ -134,6 +138,8 @@ func Fmt2Name(fmt format_t) string {
 		return "dtb"
 	case ZIMAGE:
 		return "zimage"
+	case DTBO:
+		return "dtbo"
 	default:
 		return "raw"
 	}
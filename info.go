@@ -0,0 +1,207 @@
+package magiskboot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var bootFlagNames = [BOOT_FLAGS_MAX]string{
+	MTK_KERNEL:       "MTK_KERNEL",
+	MTK_RAMDISK:      "MTK_RAMDISK",
+	CHROMEOS_FLAG:    "CHROMEOS",
+	DHTB_FLAG:        "DHTB",
+	SEANDROID_FLAG:   "SEANDROID",
+	LG_BUMP_FLAG:     "LG_BUMP",
+	SHA256_FLAG:      "SHA256",
+	BLOB_FLAG:        "BLOB",
+	NOOKHD_FLAG:      "NOOKHD",
+	ACCLAIM_FLAG:     "ACCLAIM",
+	AMONET_FLAG:      "AMONET",
+	AVB1_SIGNED_FLAG: "AVB1_SIGNED",
+	AVB_FLAG:         "AVB",
+	ZIMAGE_KERNEL:    "ZIMAGE_KERNEL",
+}
+
+// A block of the boot image, offset is relative to the start of the file
+type ComponentInfo struct {
+	Name   string `json:"name"`
+	Offset uint64 `json:"offset"`
+	Size   uint64 `json:"size"`
+	Format string `json:"format"`
+	// MTK if the block is wrapped by a MTK header, which is not counted in Offset and Size
+	Wrapper string `json:"wrapper,omitempty"`
+}
+
+type AvbInfo struct {
+	OriginalImageSize uint64 `json:"original_image_size"`
+	VbmetaOffset      uint64 `json:"vbmeta_offset"`
+	VbmetaSize        uint64 `json:"vbmeta_size"`
+	// Whether a valid vbmeta image is found at VbmetaOffset
+	Vbmeta bool `json:"vbmeta"`
+}
+
+// Structural report of a boot image, see `magiskboot info`
+type ImageInfo struct {
+	File string `json:"file"`
+	Size uint64 `json:"size"`
+	// AOSP, AOSP_VENDOR or AOSP_PXA, wrapped by CHROMEOS, DHTB or BLOB if any
+	Container     string          `json:"container"`
+	HeaderOffset  uint64          `json:"header_offset"`
+	HeaderVersion uint32          `json:"header_version"`
+	PageSize      uint32          `json:"page_size"`
+	Name          string          `json:"name,omitempty"`
+	Cmdline       string          `json:"cmdline"`
+	OsVersion     string          `json:"os_version,omitempty"`
+	OsPatchLevel  string          `json:"os_patch_level,omitempty"`
+	Components    []ComponentInfo `json:"components"`
+	TailSize      uint64          `json:"tail_size"`
+	Avb           *AvbInfo        `json:"avb,omitempty"`
+	Flags         []string        `json:"flags"`
+}
+
+func (b *BootImg) Info(file string) *ImageInfo {
+	hdr := b.Hdr
+	info := &ImageInfo{
+		File:          file,
+		Size:          uint64(len(b.Map)),
+		HeaderOffset:  b.Offsets.Header,
+		HeaderVersion: hdr.HeaderVersion(),
+		PageSize:      hdr.PageSize(),
+		Cmdline:       cstr(hdr.Cmdline()) + cstr(hdr.ExtraCmdline()),
+		Components:    []ComponentInfo{},
+		TailSize:      uint64(len(b.Tail)),
+		Flags:         []string{},
+	}
+
+	if _, ok := hdr.(*DynImgPxa); ok {
+		info.Container = "AOSP_PXA"
+	} else if hdr.IsVendor() {
+		info.Container = "AOSP_VENDOR"
+	} else {
+		info.Container = "AOSP"
+	}
+	for _, f := range []bootFlag{CHROMEOS_FLAG, DHTB_FLAG, BLOB_FLAG} {
+		if b.Flags[f] {
+			info.Container = bootFlagNames[f] + "/" + info.Container
+		}
+	}
+
+	if name := hdr.Name(); name != nil {
+		info.Name = cstr(name)
+	}
+	if os_ver := hdr.OsVersion(); os_ver != 0 {
+		major, minor, patch, y, m := decodeOsVersion(os_ver)
+		info.OsVersion = fmt.Sprintf("%d.%d.%d", major, minor, patch)
+		info.OsPatchLevel = fmt.Sprintf("%d-%02d", y, m)
+	}
+
+	add := func(name string, data []byte, off uint64, t format_t) *ComponentInfo {
+		if len(data) == 0 {
+			return nil
+		}
+		info.Components = append(info.Components, ComponentInfo{
+			Name:   name,
+			Offset: off,
+			Size:   uint64(len(data)),
+			Format: Fmt2Name(t),
+		})
+		return &info.Components[len(info.Components)-1]
+	}
+	mtk := func(c *ComponentInfo, flag bootFlag) {
+		if c != nil && b.Flags[flag] {
+			c.Wrapper = "MTK"
+		}
+	}
+	detect := func(data []byte) format_t {
+		return checkFmtLg(data, uint64(len(data)))
+	}
+
+	off := &b.Offsets
+	mtk(add("kernel", b.Kernel, off.Kernel, b.K_fmt), MTK_KERNEL)
+	add("kernel_dtb", b.KernelDtb, off.KernelDtb, detect(b.KernelDtb))
+	if hdr.VendorRamdiskTableEntryNum() != 0 {
+		for _, it := range b.VendorRamdiskEntries() {
+			data := b.Ramdisk[it.RamdiskOffset : it.RamdiskOffset+it.RamdiskSize]
+			add(filepath.Join(VND_RAMDISK_DIR, vendorRamdiskFile(it.RamdiskName[:])), data,
+				off.Ramdisk+uint64(it.RamdiskOffset), detect(data))
+		}
+	} else {
+		mtk(add("ramdisk", b.Ramdisk, off.Ramdisk, b.R_fmt), MTK_RAMDISK)
+	}
+	add("second", b.Second, off.Second, detect(b.Second))
+	add("extra", b.Extra, off.Extra, b.E_fmt)
+	add("recovery_dtbo", b.RecoveryDtbo, off.RecoveryDtbo, detect(b.RecoveryDtbo))
+	add("dtb", b.Dtb, off.Dtb, detect(b.Dtb))
+	add("signature", b.Signature, off.Signature, UNKNOWN)
+	add("vendor_ramdisk_table", b.VendorRamdiskTable, off.VendorRamdiskTable, UNKNOWN)
+	add("bootconfig", b.Bootconfig, off.Bootconfig, UNKNOWN)
+
+	if b.AvbFooter != nil {
+		info.Avb = &AvbInfo{
+			OriginalImageSize: b.AvbFooter.OriginalImageSize,
+			VbmetaOffset:      b.AvbFooter.VbmetaOffset,
+			VbmetaSize:        b.AvbFooter.VbmetaSize,
+			Vbmeta:            b.Flags[AVB_FLAG],
+		}
+	}
+
+	for f, set := range b.Flags {
+		if set {
+			info.Flags = append(info.Flags, bootFlagNames[f])
+		}
+	}
+	return info
+}
+
+func (i *ImageInfo) Print(w io.Writer) {
+	fmt.Fprintf(w, "%-*s [%s]\n", PADDING, "FILE", i.File)
+	fmt.Fprintf(w, "%-*s [%d]\n", PADDING, "SIZE", i.Size)
+	fmt.Fprintf(w, "%-*s [%s]\n", PADDING, "CONTAINER", i.Container)
+	fmt.Fprintf(w, "%-*s [0x%x]\n", PADDING, "HEADER_OFF", i.HeaderOffset)
+	fmt.Fprintf(w, "%-*s [%d]\n", PADDING, "HEADER_VER", i.HeaderVersion)
+	fmt.Fprintf(w, "%-*s [%d]\n", PADDING, "PAGESIZE", i.PageSize)
+	if i.Name != "" {
+		fmt.Fprintf(w, "%-*s [%s]\n", PADDING, "NAME", i.Name)
+	}
+	fmt.Fprintf(w, "%-*s [%s]\n", PADDING, "CMDLINE", i.Cmdline)
+	if i.OsVersion != "" {
+		fmt.Fprintf(w, "%-*s [%s]\n", PADDING, "OS_VERSION", i.OsVersion)
+		fmt.Fprintf(w, "%-*s [%s]\n", PADDING, "OS_PATCH_LEVEL", i.OsPatchLevel)
+	}
+	for _, c := range i.Components {
+		fmt.Fprintf(w, "%-*s offset=[0x%x] size=[%d] fmt=[%s]", PADDING, c.Name, c.Offset, c.Size, c.Format)
+		if c.Wrapper != "" {
+			fmt.Fprintf(w, " wrapper=[%s]", c.Wrapper)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "%-*s [%d]\n", PADDING, "TAIL_SZ", i.TailSize)
+	if i.Avb != nil {
+		fmt.Fprintf(w, "%-*s image_size=[%d] vbmeta_offset=[0x%x] vbmeta_size=[%d] vbmeta=[%v]\n",
+			PADDING, "AVB_FOOTER", i.Avb.OriginalImageSize, i.Avb.VbmetaOffset, i.Avb.VbmetaSize, i.Avb.Vbmeta)
+	}
+	for _, f := range i.Flags {
+		fmt.Fprintln(w, f)
+	}
+}
+
+// Report the structure of image to stdout, in JSON if json_out is set
+func Info(image string, json_out bool) error {
+	boot, err := NewBootImg(image)
+	if err != nil {
+		return err
+	}
+	defer boot.Close()
+
+	info := boot.Info(image)
+	if json_out {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	}
+	info.Print(os.Stdout)
+	return nil
+}
@@ -0,0 +1,124 @@
+package magiskboot_test
+
+import (
+	"encoding/json"
+	"magiskboot"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInfo(t *testing.T) {
+	t.Log("Test structural report of boot image")
+	t.Chdir(t.TempDir())
+
+	img := append(makeBootImgV2(t), []byte(magiskboot.SEANDROID_MAGIC)...)
+	if err := os.WriteFile("boot.img", img, 0644); err != nil {
+		t.Fatal(err)
+	}
+	boot := loadBootImg(t, "boot.img")
+	defer boot.Close()
+
+	info := boot.Info("boot.img")
+	if info.Container != "AOSP" || info.HeaderVersion != 2 || info.PageSize != 2048 || info.HeaderOffset != 0 {
+		t.Fatalf("Header info mismatch, Except: %v, But: %v", []any{"AOSP", 2, 2048, 0},
+			[]any{info.Container, info.HeaderVersion, info.PageSize, info.HeaderOffset})
+	}
+
+	gz_kernel := gzipData(t, testKernel)
+	expect := []magiskboot.ComponentInfo{
+		{Name: "kernel", Offset: 2048, Size: uint64(len(gz_kernel)), Format: "gzip"},
+		{Name: "ramdisk", Offset: 2048 * 2, Size: uint64(len(testRamdisk)), Format: "raw"},
+		{Name: "second", Offset: 2048 * 3, Size: uint64(len(testSecond)), Format: "raw"},
+		{Name: "recovery_dtbo", Offset: 2048 * 4, Size: uint64(len(testDtbo)), Format: "raw"},
+		{Name: "dtb", Offset: 2048 * 5, Size: uint64(len(testDtb)), Format: "raw"},
+	}
+	if !reflect.DeepEqual(info.Components, expect) {
+		t.Fatalf("Components mismatch\nExcept: %v\nBut: %v", expect, info.Components)
+	}
+	if !reflect.DeepEqual(info.Flags, []string{"SEANDROID"}) || info.Avb != nil {
+		t.Fatalf("Tail info mismatch, Except: %v, But: %v", []any{[]string{"SEANDROID"}, nil}, []any{info.Flags, info.Avb})
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ret magiskboot.ImageInfo
+	if err := json.Unmarshal(data, &ret); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&ret, info) {
+		t.Fatalf("JSON round trip mismatch\nExcept: %+v\nBut: %+v", info, ret)
+	}
+}
+
+func TestInfoMtk(t *testing.T) {
+	t.Log("Test structural report of boot image with MTK headers")
+	t.Chdir(t.TempDir())
+
+	gz_kernel := gzipData(t, testKernel)
+	kernel := mtkWrap(t, "KERNEL", gz_kernel)
+	ramdisk := mtkWrap(t, "ROOTFS", testRamdisk)
+	hdr := magiskboot.BootImgHdrV0{}
+	copy(hdr.Magic[:], magiskboot.BOOT_MAGIC)
+	hdr.KernelSize = uint32(len(kernel))
+	hdr.RamdiskSize = uint32(len(ramdisk))
+	hdr.PageSize = 2048
+	if err := os.WriteFile("boot.img", makeBootImg(t, &hdr, 2048, kernel, ramdisk), 0644); err != nil {
+		t.Fatal(err)
+	}
+	boot := loadBootImg(t, "boot.img")
+	defer boot.Close()
+
+	// Blocks start after the 512 bytes MTK header
+	info := boot.Info("boot.img")
+	expect := []magiskboot.ComponentInfo{
+		{Name: "kernel", Offset: 2048 + 512, Size: uint64(len(gz_kernel)), Format: "gzip", Wrapper: "MTK"},
+		{Name: "ramdisk", Offset: 2048*2 + 512, Size: uint64(len(testRamdisk)), Format: "raw", Wrapper: "MTK"},
+	}
+	if !reflect.DeepEqual(info.Components, expect) {
+		t.Fatalf("Components mismatch\nExcept: %+v\nBut: %+v", expect, info.Components)
+	}
+	if info.Container != "AOSP" || !reflect.DeepEqual(info.Flags, []string{"MTK_KERNEL", "MTK_RAMDISK"}) {
+		t.Fatalf("Header info mismatch, Except: %v, But: %v", []any{"AOSP", []string{"MTK_KERNEL", "MTK_RAMDISK"}},
+			[]any{info.Container, info.Flags})
+	}
+
+	buf := new(strings.Builder)
+	info.Print(buf)
+	if !strings.Contains(buf.String(), "fmt=[gzip] wrapper=[MTK]\n") {
+		t.Fatalf("Print mismatch, Except: %q, But: %q", "wrapper=[MTK]", buf.String())
+	}
+}
+
+func TestInfoZimage(t *testing.T) {
+	t.Log("Test structural report of shifted boot image with zImage kernel")
+	t.Chdir(t.TempDir())
+
+	piggy := gzipData(t, testKernel)
+	zimage := makeZimage(t, piggy)
+	hdr := magiskboot.BootImgHdrV0{}
+	copy(hdr.Magic[:], magiskboot.BOOT_MAGIC)
+	hdr.KernelSize = uint32(len(zimage))
+	hdr.RamdiskSize = uint32(len(testRamdisk))
+	hdr.PageSize = 2048
+	// Unknown data in front of the boot image
+	img := append(make([]byte, 4096), makeBootImg(t, &hdr, 2048, zimage, testRamdisk)...)
+	if err := os.WriteFile("boot.img", img, 0644); err != nil {
+		t.Fatal(err)
+	}
+	boot := loadBootImg(t, "boot.img")
+	defer boot.Close()
+
+	// Kernel is the piggy inside zImage
+	info := boot.Info("boot.img")
+	expect := []magiskboot.ComponentInfo{
+		{Name: "kernel", Offset: 4096 + 2048 + testZimageHdrSz, Size: uint64(len(piggy)), Format: "gzip"},
+		{Name: "ramdisk", Offset: 4096 + 2048*2, Size: uint64(len(testRamdisk)), Format: "raw"},
+	}
+	if info.HeaderOffset != 4096 || !reflect.DeepEqual(info.Components, expect) {
+		t.Fatalf("Components mismatch\nExcept: %+v\nBut: %+v", []any{4096, expect}, []any{info.HeaderOffset, info.Components})
+	}
+}
@@ -2,11 +2,10 @@ package magiskboot
 
 import (
 	"crypto/sha1"
-	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -15,11 +14,14 @@ const (
 	KERNEL_FILE     = "kernel"
 	RAMDISK_FILE    = "ramdisk.cpio"
 	VND_RAMDISK_DIR = "vendor_ramdisk"
+	VND_RAMDISK_TBL = "vendor_ramdisk_table"
 	SECOND_FILE     = "second"
 	EXTRA_FILE      = "extra"
 	KER_DTB_FILE    = "kernel_dtb"
 	RECV_DTBO_FILE  = "recovery_dtbo"
 	DTB_FILE        = "dtb"
+	DTBO_DIR        = "dtbo"
+	DTBO_TBL        = "dtbo_table"
 	BOOTCONFIG_FILE = "bootconfig"
 	NEW_BOOT        = "new-boot.img"
 )
@@ -74,6 +76,12 @@ Supported actions:
     If env variable PATCHVBMETAFLAG is set to true, all disable flags in
     the boot image's vbmeta header will be set.
 
+  info [--json] <bootimg>
+    Report the structure of <bootimg> to STDOUT: the detected container,
+    header version, page size, offset, size and format of each component,
+    cmdline, OS version, AVB footer and special tail flags.
+    If '--json' is provided, the report will be printed in JSON.
+
   verify <bootimg> [x509.pem]
     Check whether the boot image is signed with AVB 1.0 signature.
     Optionally provide a certificate to verify whether the image is
@@ -108,10 +116,25 @@ Supported actions:
     Do dtb related actions to <file>.
     See "dtb --help" for supported actions.
 
-  split [-n] <file>
+  dtbo <file> <action> [args...]
+    Do DT table related actions to <file>, e.g. dtbo.img or recovery_dtbo.
+    See "dtbo --help" for supported actions.
+
+  split [-n] [-a] <file>
     Split image.*-dtb into kernel + kernel_dtb.
+    All appended DTBs are listed with their offset, size, model and
+    compatible strings.
     If '-n' is provided, decompression operations will be skipped;
     the kernel will remain untouched, split in its original format.
+    If '-a' is provided, each DTB will also be written to kernel_dtb.N.
+
+  merge [-n] <origfile> [outfile]
+    Join kernel + kernel_dtb back into [outfile], or 'new-<origfile>'
+    if not specified. This is the inverse of split; if kernel_dtb does
+    not exist, kernel_dtb.N files written by 'split -a' are joined.
+    <origfile> is the original image used to split the components.
+    The kernel is compressed in the format detected in <origfile>.
+    If '-n' is provided, compression operations will be skipped.
 
   sha1 <file>
     Print the SHA1 checksum for <file>
@@ -152,7 +175,21 @@ func Main(args []string) {
 	// Skip '--' for backwards compatibility
 	action := strings.TrimLeft(args[1], "-")
 
-	notImplError := errors.New("not impl yet")
+	// Errors from the library are only turned into exit codes here
+	exit := func(code int, err error) {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			if code == 0 {
+				code = 1
+			}
+		}
+		os.Exit(code)
+	}
+	check := func(err error) {
+		if err != nil {
+			exit(1, err)
+		}
+	}
 
 	if action == "cleanup" {
 		fmt.Fprintf(os.Stderr, "Cleaning up...\n")
@@ -166,52 +203,142 @@ func Main(args []string) {
 			RECV_DTBO_FILE,
 			DTB_FILE,
 			BOOTCONFIG_FILE,
+			VND_RAMDISK_TBL,
 		} {
 			os.Remove(f)
 		}
 		os.RemoveAll(VND_RAMDISK_DIR)
 	} else if len(args) > 2 && action == "sha1" {
 		fd, err := os.Open(args[2])
-		if err != nil {
-			log.Fatalln("Error:", err)
-		}
+		check(err)
 		defer fd.Close()
 
 		hash := sha1.New()
-		if _, err := io.Copy(hash, fd); err != nil {
-			panic(err)
-		}
+		_, err = io.Copy(hash, fd)
+		check(err)
 		_sha1 := hash.Sum(nil)
 		fmt.Printf("%x\n", _sha1)
-	} else if len(args) > 2 && action == "split" { // TODO:
-		if args[2] == "-n" {
+	} else if len(args) > 2 && action == "split" {
+		idx := 2
+		nodecomp := false
+		all := false
+		for {
+			if idx >= len(args) {
+				Usage()
+			}
+			if !strings.HasPrefix(args[idx], "-") {
+				break
+			}
+			for _, flag := range args[idx][1:] {
+				switch flag {
+				case 'n':
+					nodecomp = true
+				case 'a':
+					all = true
+				default:
+					Usage()
+				}
+			}
+			idx++
+		}
+		check(SplitImageDtb(args[idx], nodecomp, all))
+	} else if len(args) > 2 && action == "merge" {
+		nocomp := args[2] == "-n"
+		idx := 2
+		if nocomp {
 			if len(args) == 3 {
 				Usage()
 			}
-			os.Exit(SplitImageDtb(args[3], true))
-		} else {
-			os.Exit(SplitImageDtb(args[2], false))
+			idx++
+		}
+		out := "new-" + filepath.Base(args[idx])
+		if len(args) > idx+1 {
+			out = args[idx+1]
 		}
+		check(MergeImageDtb(args[idx], out, nocomp))
 	} else if len(args) > 2 && action == "unpack" {
-		panic(notImplError)
+		idx := 2
+		nodecomp := false
+		hdr := false
+		for {
+			if idx >= len(args) {
+				Usage()
+			}
+			if !strings.HasPrefix(args[idx], "-") {
+				break
+			}
+			for _, flag := range args[idx][1:] {
+				switch flag {
+				case 'n':
+					nodecomp = true
+				case 'h':
+					hdr = true
+				default:
+					Usage()
+				}
+			}
+			idx++
+		}
+		exit(Unpack(args[idx], nodecomp, hdr))
 	} else if len(args) > 2 && action == "repack" {
-		panic(notImplError)
+		out := NEW_BOOT
+		if args[2] == "-n" {
+			if len(args) == 3 {
+				Usage()
+			}
+			if len(args) > 4 {
+				out = args[4]
+			}
+			check(Repack(args[3], out, true))
+		} else {
+			if len(args) > 3 {
+				out = args[3]
+			}
+			check(Repack(args[2], out, false))
+		}
+	} else if len(args) > 2 && action == "info" {
+		if args[2] == "--json" {
+			if len(args) == 3 {
+				Usage()
+			}
+			check(Info(args[3], true))
+		} else {
+			check(Info(args[2], false))
+		}
 	} else if len(args) > 2 && action == "verify" {
-		panic(notImplError)
+		cert := ""
+		if len(args) > 3 {
+			cert = args[3]
+		}
+		boot, err := NewBootImg(args[2])
+		check(err)
+		defer boot.Close()
+		if err := boot.Verify(cert); err != nil {
+			fmt.Fprintln(os.Stderr, "Verification failed:", err)
+			os.Exit(1)
+		}
 	} else if len(args) > 2 && action == "sign" {
 		if len(args) == 5 {
 			Usage()
 		}
-		panic(notImplError)
+		name := "/boot"
+		if len(args) > 3 {
+			name = args[3]
+		}
+		cert, key := "", ""
+		if len(args) > 5 {
+			cert, key = args[4], args[5]
+		}
+		check(Sign(args[2], name, cert, key))
 	} else if len(args) > 2 && action == "decompress" {
-		Decompress(args[2], func() string {
+		check(Decompress(args[2], func() string {
 			if len(args) > 3 {
 				return args[3]
 			}
 			return ""
-		}())
+		}()))
 	} else if len(args) > 2 && strings.HasPrefix(action, "compress") {
-		Compress(func() string {
+		check(Compress(func() string {
 			if len(action) > 8 && action[8] == '=' {
 				return action[9:]
 			}
@@ -224,44 +351,37 @@ func Main(args []string) {
 				}
 				return ""
 			}(),
-		)
+		))
 	} else if len(args) > 4 && action == "hexpatch" {
-		os.Exit(func() int {
-			if HexPatch(args[2], args[3], args[4]) {
-				return 0
-			} else {
-				return 1
-			}
-		}())
+		patched, err := HexPatch(args[2], args[3], args[4])
+		check(err)
+		if !patched {
+			os.Exit(1)
+		}
 	} else if len(args) > 2 && action == "cpio" {
-		CpioCommands(args[2:])
-		os.Exit(0)
+		exit(CpioCommands(args[2:]))
 	} else if len(args) > 2 && action == "dtb" {
-		panic(notImplError)
+		exit(DtbCommands(args[2:]))
+	} else if len(args) > 2 && action == "dtbo" {
+		exit(DtboCommands(args[2:]))
 	} else if len(args) > 2 && action == "extract" {
-		os.Exit(func() int {
-			if ExtractBootFromPayload(
-				args[2],
-				func() string {
-					if len(args) > 3 {
-						return args[3]
-					} else {
-						return ""
-					}
-				}(),
-				func() string {
-					if len(args) > 4 {
-						return args[4]
-					} else {
-						return ""
-					}
-				}(),
-			) {
-				return 0
-			} else {
-				return 1
-			}
-		}())
+		check(ExtractBootFromPayload(
+			args[2],
+			func() string {
+				if len(args) > 3 {
+					return args[3]
+				} else {
+					return ""
+				}
+			}(),
+			func() string {
+				if len(args) > 4 {
+					return args[4]
+				} else {
+					return ""
+				}
+			}(),
+		))
 	} else {
 		Usage()
 	}
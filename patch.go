@@ -3,8 +3,8 @@ package magiskboot
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 
 	"github.com/edsrzf/mmap-go"
@@ -56,28 +56,10 @@ func patchFstab(fstabContent []byte, patterns [][]byte) []byte {
 			continue
 		}
 
-		// 处理 fs_mgr_flags (第4个字段)
-		flags := bytes.Split(fields[4], []byte{','})
-		var newFlags [][]byte
-
-		for _, flag := range flags {
-			shouldRemove := false
-			for _, pattern := range patterns {
-				if bytes.HasPrefix(flag, pattern) {
-					fmt.Printf("Remove pattern [%s]\n", flag)
-					shouldRemove = true
-					break
-				}
-			}
-			if !shouldRemove {
-				newFlags = append(newFlags, flag)
-			}
-		}
-
-		// 重建行
+		// 重建行, 处理 fs_mgr_flags (第4个字段)
 		newLine := bytes.Join([][]byte{
 			bytes.Join(fields[:4], []byte{' '}),
-			bytes.Join(newFlags, []byte{','}),
+			removeFlags(fields[4], patterns),
 		}, []byte{' '})
 
 		// 如果有第5个字段，追加到行尾
@@ -92,50 +74,64 @@ func patchFstab(fstabContent []byte, patterns [][]byte) []byte {
 	return bytes.Join(result, []byte{'\n'})
 }
 
-func HexPatch(file, from, to string) bool {
+// removeFlags 从逗号分隔的 fs_mgr_flags 中移除匹配的标记
+func removeFlags(flags []byte, patterns [][]byte) []byte {
+	var newFlags [][]byte
+
+	for _, flag := range bytes.Split(flags, []byte{','}) {
+		shouldRemove := false
+		for _, pattern := range patterns {
+			if bytes.HasPrefix(flag, pattern) {
+				fmt.Printf("Remove pattern [%s]\n", flag)
+				shouldRemove = true
+				break
+			}
+		}
+		if !shouldRemove {
+			newFlags = append(newFlags, flag)
+		}
+	}
+	return bytes.Join(newFlags, []byte{','})
+}
+
+func HexPatch(file, from, to string) (bool, error) {
+	from_b, err := hex.DecodeString(from)
+	if err != nil {
+		return false, err
+	}
+	to_b, err := hex.DecodeString(to)
+	if err != nil {
+		return false, err
+	}
+	if len(from_b) == 0 {
+		return false, errors.New("empty hex pattern")
+	}
+
 	fd, err := os.OpenFile(file, os.O_RDWR, 0644)
 	if err != nil {
-		log.Fatalln(err)
+		return false, err
 	}
 	defer fd.Close()
 	fstat, err := fd.Stat()
 	if err != nil {
-		log.Fatalln(err)
+		return false, err
 	}
 	fsize := fstat.Size()
 
-	from_b, err := hex.DecodeString(from)
+	m, err := mmap.Map(fd, mmap.RDWR, 0)
 	if err != nil {
-		log.Fatalln(err)
-	}
-	to_b, err := hex.DecodeString(to)
-	if err != nil {
-		log.Fatalln(err)
+		return false, err
 	}
+	defer m.Unmap()
 
 	patched := false
-	if m, err := mmap.Map(fd, mmap.RDWR, 0); err == nil {
-		for i := int64(0); i < fsize; i++ {
-			var match bool = false
-			if from_b[0] == m[i] {
-				match = true
-				for j := 0; j < len(from_b); j++ {
-					if from_b[j] != m[i+int64(j)] {
-						match = false
-						break
-					}
-				}
-
-				if match {
-					copy(m[i:], to_b)
-					fmt.Fprintf(os.Stderr, "Patch @ 0x%08X [%s] -> [%s]\n", i, from, to)
-					patched = true
-				}
-			}
+	for i := int64(0); i+int64(len(from_b)) <= fsize; i++ {
+		if bytes.Equal(m[i:i+int64(len(from_b))], from_b) {
+			copy(m[i:], to_b)
+			fmt.Fprintf(os.Stderr, "Patch @ 0x%08X [%s] -> [%s]\n", i, from, to)
+			patched = true
 		}
-	} else {
-		log.Fatalln(err)
 	}
 
-	return patched
+	return patched, m.Flush()
 }
@@ -17,7 +17,9 @@ func TestHexPatch(t *testing.T) {
 	} else {
 		fd.WriteString("12345678901234567890")
 		fd.Close()
-		magiskboot.HexPatch("test.bin", "31323334", "35363738")
+		if patched, err := magiskboot.HexPatch("test.bin", "31323334", "35363738"); !patched || err != nil {
+			t.Fatalf("Except: %v, But: %v", true, err)
+		}
 		expect := []byte("56785678905678567890")
 		if fd, err = os.Open("test.bin"); err != nil {
 			t.Fatal(err)
@@ -6,8 +6,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
-
 	"os"
 	"slices"
 	"sort"
@@ -28,27 +26,23 @@ func doExtractBootFromPayload(
 	partition_name string,
 	out_path string,
 ) error {
-	var reader io.ReadSeekCloser = func() io.ReadSeekCloser {
-		if in_path == "-" {
-			return os.Stdin
-		} else {
-			fd, err := os.Open(in_path)
-			if err != nil {
-				log.Fatalln(err)
-			}
-			return fd
+	var reader io.ReadSeekCloser = os.Stdin
+	if in_path != "-" {
+		fd, err := os.Open(in_path)
+		if err != nil {
+			return err
 		}
-	}()
+		reader = fd
+	}
 	defer reader.Close()
 
 	buf := make([]byte, 4)
-	_, err := reader.Read(buf)
-	if err != nil {
-		log.Fatalln(err)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return truncated("payload header: %v", err)
 	}
 
 	if !bytes.Equal(buf, []byte(PAYLOAD_MAGIC)) {
-		return badPayload("invalid magic")
+		return badMagic("invalid payload magic")
 	}
 
 	var version uint64
@@ -70,13 +64,12 @@ func doExtractBootFromPayload(
 	}
 
 	buf = make([]byte, manifest_len)
-	_, err = reader.Read(buf)
-	if err != nil {
-		log.Fatalln(err)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return truncated("payload manifest: %v", err)
 	}
 	manifest := new(update_engine.DeltaArchiveManifest)
 	if err := manifest.Unmarshal(buf); err != nil {
-		log.Fatalln(err)
+		return badPayload(err.Error())
 	}
 	if manifest.GetMinorVersion() != 0 {
 		return badPayload("delta payloads are not supported, please use a full payload file")
@@ -99,9 +92,6 @@ func doExtractBootFromPayload(
 					}
 				}
 			}
-			if boot == nil {
-				log.Fatalln(badPayload("boot partition not found"))
-			}
 			return boot
 		} else {
 			for _, p := range manifest.Partitions {
@@ -109,11 +99,15 @@ func doExtractBootFromPayload(
 					return p
 				}
 			}
-			log.Fatalln(badPayload("partition " + partition_name + " not found"))
-
 		}
 		return nil
 	}()
+	if partition == nil {
+		if partition_name == "" {
+			return badPayload("boot partition not found")
+		}
+		return badPayload("partition " + partition_name + " not found")
+	}
 
 	var out_str string
 	out_path = func() string {
@@ -127,7 +121,7 @@ func doExtractBootFromPayload(
 
 	out_file, err := os.Create(out_path)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
 	defer out_file.Close()
 
@@ -163,9 +157,8 @@ func doExtractBootFromPayload(
 		switch data_type {
 		case update_engine.REPLACE:
 			out_file.Seek(int64(out_offset), io.SeekStart)
-			_, err := out_file.Write(buf)
-			if err != nil {
-				log.Fatalln(err)
+			if _, err := out_file.Write(buf); err != nil {
+				return err
 			}
 		case update_engine.ZERO:
 			for _, ext := range operation.GetDstExtents() {
@@ -177,8 +170,8 @@ func doExtractBootFromPayload(
 		case update_engine.REPLACE_BZ,
 			update_engine.REPLACE_XZ:
 			out_file.Seek(int64(out_offset), io.SeekStart)
-			if !DecompressToFd(buf, out_file) {
-				return badPayload("decompression failed")
+			if err := DecompressToFd(buf, out_file); err != nil {
+				return fmt.Errorf("invalid payload: decompression failed: %w", err)
 			}
 		default:
 			fmt.Fprintln(os.Stderr, "DATA_TYPE: ", data_type)
@@ -186,21 +179,17 @@ func doExtractBootFromPayload(
 		}
 
 	}
-	return nil
+	return out_file.Close()
 }
 
 func ExtractBootFromPayload(
 	in_path,
 	partition,
 	out_path string,
-) bool {
+) error {
 	in_path = strings.TrimRight(in_path, " ")
 	partition = strings.TrimRight(partition, " ")
 	out_path = strings.TrimRight(out_path, " ")
 
-	if err := doExtractBootFromPayload(in_path, partition, out_path); err != nil {
-		log.Println(err)
-		return false
-	}
-	return true
+	return doExtractBootFromPayload(in_path, partition, out_path)
 }
@@ -0,0 +1,289 @@
+package magiskboot
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	_ "embed"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// AOSP verity key pair used when no certificate/private key is provided
+var (
+	//go:embed keys/verity.x509.pem
+	verityCert []byte
+	//go:embed keys/verity.pk8
+	verityKey []byte
+)
+
+/*
+AVB 1.0 signature appended to the boot image payload
+
+	BootSignature ::= SEQUENCE {
+	    formatVersion ::= INTEGER,
+	    certificate ::= Certificate,
+	    algorithmIdentifier ::= SEQUENCE {
+	        algorithm OBJECT IDENTIFIER,
+	        parameters ANY DEFINED BY algorithm OPTIONAL
+	    },
+	    authenticatedAttributes ::= SEQUENCE {
+	        target CHARACTER STRING,
+	        length INTEGER
+	    },
+	    signature ::= OCTET STRING
+	}
+*/
+type BootSignature struct {
+	FormatVersion           int
+	Certificate             asn1.RawValue
+	AlgorithmIdentifier     pkix.AlgorithmIdentifier
+	AuthenticatedAttributes asn1.RawValue
+	Signature               []byte
+}
+
+type AuthenticatedAttributes struct {
+	Target string `asn1:"printable"`
+	Length int64
+}
+
+var (
+	oidSHA1WithRSA     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 5}
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSHA384WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidSHA512WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+)
+
+func sigHash(alg asn1.ObjectIdentifier) crypto.Hash {
+	switch {
+	case alg.Equal(oidSHA1WithRSA):
+		return crypto.SHA1
+	case alg.Equal(oidSHA256WithRSA), alg.Equal(oidECDSAWithSHA256):
+		return crypto.SHA256
+	case alg.Equal(oidSHA384WithRSA), alg.Equal(oidECDSAWithSHA384):
+		return crypto.SHA384
+	case alg.Equal(oidSHA512WithRSA), alg.Equal(oidECDSAWithSHA512):
+		return crypto.SHA512
+	}
+	return 0
+}
+
+func parseCertPem(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("invalid x509 certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func readCertPem(file string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parseCertPem(data)
+}
+
+// Private key in PKCS#8 format, either DER or PEM encoded
+func parsePk8(data []byte) (crypto.Signer, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	key, err := x509.ParsePKCS8PrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+	return signer, nil
+}
+
+func readPk8(file string) (crypto.Signer, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parsePk8(data)
+}
+
+// Same choice of digest as AOSP BootSignature.getSignatureAlgorithm
+func signAlgorithm(key crypto.Signer) (pkix.AlgorithmIdentifier, crypto.Hash, error) {
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		return pkix.AlgorithmIdentifier{
+			Algorithm:  oidSHA256WithRSA,
+			Parameters: asn1.NullRawValue,
+		}, crypto.SHA256, nil
+	case *ecdsa.PublicKey:
+		switch bits := pub.Curve.Params().BitSize; {
+		case bits <= 256:
+			return pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}, crypto.SHA256, nil
+		case bits <= 384:
+			return pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA384}, crypto.SHA384, nil
+		default:
+			return pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA512}, crypto.SHA512, nil
+		}
+	}
+	return pkix.AlgorithmIdentifier{}, 0, errors.New("unsupported private key type")
+}
+
+func signBootSignature(payload []byte, name string, cert *x509.Certificate, key crypto.Signer) ([]byte, error) {
+	alg, h, err := signAlgorithm(key)
+	if err != nil {
+		return nil, err
+	}
+	attr, err := asn1.Marshal(AuthenticatedAttributes{
+		Target: name,
+		Length: int64(len(payload)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hash := h.New()
+	hash.Write(payload)
+	hash.Write(attr)
+	sig, err := key.Sign(rand.Reader, hash.Sum(nil), h)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(BootSignature{
+		FormatVersion:           1,
+		Certificate:             asn1.RawValue{FullBytes: cert.Raw},
+		AlgorithmIdentifier:     alg,
+		AuthenticatedAttributes: asn1.RawValue{FullBytes: attr},
+		Signature:               sig,
+	})
+}
+
+// Decode the signature at the start of tail, trailing data (usually zeros) is ignored
+func parseBootSignature(tail []byte) (*BootSignature, *AuthenticatedAttributes, error) {
+	sig := new(BootSignature)
+	if _, err := asn1.Unmarshal(tail, sig); err != nil {
+		return nil, nil, err
+	}
+	attr := new(AuthenticatedAttributes)
+	if _, err := asn1.Unmarshal(sig.AuthenticatedAttributes.FullBytes, attr); err != nil {
+		return nil, nil, err
+	}
+	return sig, attr, nil
+}
+
+// Verify the AVB 1.0 signature in tail over payload.
+// If cert is nil, the certificate embedded in the signature is used.
+func verifyBootSignature(payload, tail []byte, cert *x509.Certificate) error {
+	sig, attr, err := parseBootSignature(tail)
+	if err != nil {
+		return err
+	}
+	if attr.Length != int64(len(payload)) {
+		return errors.New("invalid image size")
+	}
+	if cert == nil {
+		if cert, err = x509.ParseCertificate(sig.Certificate.FullBytes); err != nil {
+			return err
+		}
+	}
+
+	h := sigHash(sig.AlgorithmIdentifier.Algorithm)
+	if h == 0 || !h.Available() {
+		return fmt.Errorf("unsupported signature algorithm %v", sig.AlgorithmIdentifier.Algorithm)
+	}
+	hash := h.New()
+	hash.Write(payload)
+	hash.Write(sig.AuthenticatedAttributes.FullBytes)
+	digest := hash.Sum(nil)
+
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, h, digest, sig.Signature)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest, sig.Signature) {
+			return errors.New("ecdsa: verification error")
+		}
+		return nil
+	}
+	return errors.New("unsupported public key type")
+}
+
+func (b *BootImg) Verify(cert string) error {
+	var c *x509.Certificate
+	var err error
+	if cert == "" {
+		c, err = parseCertPem(verityCert)
+	} else {
+		c, err = readCertPem(cert)
+	}
+	if err != nil {
+		return err
+	}
+	return verifyBootSignature(b.Payload, b.Tail, c)
+}
+
+// Create the AVB 1.0 signature of payload.
+// If cert and key are empty, the bundled verity key is used.
+func SignBootImage(payload []byte, name, cert, key string) ([]byte, error) {
+	var c *x509.Certificate
+	var k crypto.Signer
+	var err error
+	if cert == "" && key == "" {
+		if c, err = parseCertPem(verityCert); err != nil {
+			return nil, err
+		}
+		k, err = parsePk8(verityKey)
+	} else {
+		if c, err = readCertPem(cert); err != nil {
+			return nil, err
+		}
+		k, err = readPk8(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return signBootSignature(payload, name, c, k)
+}
+
+func Sign(image, name, cert, key string) error {
+	boot, err := NewBootImg(image)
+	if err != nil {
+		return err
+	}
+	defer boot.Close()
+
+	sig, err := SignBootImage(boot.Payload, name, cert, key)
+	if err != nil {
+		return err
+	}
+
+	fd, err := os.OpenFile(image, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	eod := int64(len(boot.Map) - len(boot.Tail))
+	if _, err := fd.WriteAt(sig, eod); err != nil {
+		return err
+	}
+
+	// Wipe out rest of tail
+	if rest := int64(len(boot.Map)) - eod - int64(len(sig)); rest > 0 {
+		if _, err := fd.WriteAt(make([]byte, rest), eod+int64(len(sig))); err != nil {
+			return err
+		}
+	}
+	return fd.Close()
+}
@@ -0,0 +1,144 @@
+package magiskboot_test
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"magiskboot"
+	"math/big"
+	"os"
+	"testing"
+)
+
+func makeTestCert(t *testing.T) (*rsa.PrivateKey, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "magiskboot test"},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, cert
+}
+
+func signTestImage(t *testing.T, payload []byte, key *rsa.PrivateKey, cert []byte) []byte {
+	attr, err := asn1.Marshal(magiskboot.AuthenticatedAttributes{
+		Target: "/boot",
+		Length: int64(len(payload)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.New()
+	hash.Write(payload)
+	hash.Write(attr)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := asn1.Marshal(magiskboot.BootSignature{
+		FormatVersion: 1,
+		Certificate:   asn1.RawValue{FullBytes: cert},
+		AlgorithmIdentifier: pkix.AlgorithmIdentifier{
+			Algorithm:  asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11},
+			Parameters: asn1.NullRawValue,
+		},
+		AuthenticatedAttributes: asn1.RawValue{FullBytes: attr},
+		Signature:               sig,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestVerify(t *testing.T) {
+	t.Log("Test AVB1 signature verification")
+	t.Chdir(t.TempDir())
+
+	key, cert := makeTestCert(t)
+	payload := makeBootImgV2(t)
+	img := append(payload, signTestImage(t, payload, key, cert)...)
+	img = append(img, make([]byte, 4096)...)
+	if err := os.WriteFile("boot.img", img, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("x509.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	boot := loadBootImg(t, "boot.img")
+	defer boot.Close()
+
+	if !boot.Flags[magiskboot.AVB1_SIGNED_FLAG] {
+		t.Fatalf("AVB1_SIGNED_FLAG, Except: %v, But: %v", true, false)
+	}
+	if err := boot.Verify("x509.pem"); err != nil {
+		t.Fatalf("Verify with cert, Except: %v, But: %v", nil, err)
+	}
+	// Not signed by the bundled verity key
+	if err := boot.Verify(""); err == nil {
+		t.Fatalf("Verify with verity key, Except: %v, But: %v", "error", err)
+	}
+}
+
+func TestSign(t *testing.T) {
+	t.Log("Test AVB1 signing")
+	t.Chdir(t.TempDir())
+
+	if err := os.WriteFile("boot.img", makeBootImgV2(t), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bundled verity key
+	if err := magiskboot.Sign("boot.img", "/boot", "", ""); err != nil {
+		t.Fatalf("Sign failed, Except: %v, But: %v", nil, err)
+	}
+	boot := loadBootImg(t, "boot.img")
+	if !boot.Flags[magiskboot.AVB1_SIGNED_FLAG] {
+		t.Fatalf("AVB1_SIGNED_FLAG, Except: %v, But: %v", true, false)
+	}
+	if err := boot.Verify(""); err != nil {
+		t.Fatalf("Verify with verity key, Except: %v, But: %v", nil, err)
+	}
+	boot.Close()
+
+	// Repack should keep the image signed
+	unpack(t, "boot.img", false, false)
+	repack(t, "boot.img", "new-boot.img", false)
+	boot = loadBootImg(t, "new-boot.img")
+	if err := boot.Verify(""); err != nil {
+		t.Fatalf("Verify repacked image, Except: %v, But: %v", nil, err)
+	}
+	boot.Close()
+
+	// User provided certificate and private key
+	key, cert := makeTestCert(t)
+	pk8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile("x509.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0644)
+	os.WriteFile("key.pk8", pk8, 0644)
+	if err := magiskboot.Sign("boot.img", "/boot", "x509.pem", "key.pk8"); err != nil {
+		t.Fatalf("Sign failed, Except: %v, But: %v", nil, err)
+	}
+	boot = loadBootImg(t, "boot.img")
+	defer boot.Close()
+	if err := boot.Verify("x509.pem"); err != nil {
+		t.Fatalf("Verify with cert, Except: %v, But: %v", nil, err)
+	}
+	if err := boot.Verify(""); err == nil {
+		t.Fatalf("Verify with verity key, Except: %v, But: %v", "error", err)
+	}
+}